@@ -1,20 +1,54 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/BurntSushi/toml"
 	"github.com/daskol/telepyth/srv"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var storage *srv.Storage
 
 type Config struct {
-	Token      string `toml:"token"`
-	Storage    string `toml:"storage"`
-	Polling    bool   `toml:"polling"`
-	Timeout    int    `toml:"timeout"`
-	MetricsLog string `toml:"metrics_log"`
+	Token       string `toml:"token"`
+	Storage     string `toml:"storage"`
+	Polling     bool   `toml:"polling"`
+	Timeout     int    `toml:"timeout"`
+	MetricsLog  string `toml:"metrics_log"`
+	ApiEndpoint string `toml:"api_endpoint"`
+	ApiTimeout  int    `toml:"api_timeout"`
+	AdminToken  string `toml:"admin_token"`
+
+	// TokenKey is a secret key of token hashes which are stored in database.
+	TokenKey string `toml:"token_key"`
+
+	// TrustedProxies are CIDR blocks of reverse proxies in front of server.
+	TrustedProxies []string `toml:"trusted_proxies"`
+
+	// RotationGrace is how many hours rotated token stays valid.
+	RotationGrace int `toml:"rotation_grace"`
+
+	// Lockout limits failed authentications per client address.
+	Lockout LockoutConfig `toml:"lockout"`
+
+	WebhookURL    string `toml:"webhook_url"`
+	WebhookCert   string `toml:"webhook_cert"`
+	WebhookSecret string `toml:"webhook_secret"`
+}
+
+// LockoutConfig configures lockout of client addresses which fail to
+// authenticate. Delay of the first lockout is in seconds and window which
+// failures are remembered for is in hours.
+type LockoutConfig struct {
+	Enabled   bool `toml:"enabled"`
+	Threshold int  `toml:"threshold"`
+	Delay     int  `toml:"delay"`
+	Window    int  `toml:"window"`
 }
 
 func main() {
@@ -26,15 +60,27 @@ func main() {
 		"Create or open a database at the given path.")
 	polling := flag.Bool("polling", false, "Use long polling to get updates")
 	timeout := flag.Int("timeout", 30, "Timeout in seconds for long polling.")
+	apiEndpoint := flag.String("api-endpoint", srv.DefaultEndpoint,
+		"Base URL of Telegram Bot API server.")
+	apiTimeout := flag.Int("api-timeout", 30,
+		"Timeout in seconds for requests to Telegram Bot API.")
 
 	flag.Parse()
 
 	config := &Config{
-		Token:      *token,
-		Storage:    *dbPath,
-		Polling:    *polling,
-		Timeout:    *timeout,
-		MetricsLog: *metricsLog,
+		Token:       *token,
+		Storage:     *dbPath,
+		Polling:     *polling,
+		Timeout:     *timeout,
+		MetricsLog:  *metricsLog,
+		ApiEndpoint: *apiEndpoint,
+		ApiTimeout:  *apiTimeout,
+		Lockout: LockoutConfig{
+			Enabled:   true,
+			Threshold: 10,
+			Delay:     60,
+			Window:    24,
+		},
 	}
 
 	if len(*configPath) != 0 {
@@ -44,19 +90,43 @@ func main() {
 		}
 	}
 
+	if !config.Lockout.Enabled {
+		// lockout settings are not used
+	} else if config.Lockout.Threshold <= 0 || config.Lockout.Delay <= 0 ||
+		config.Lockout.Window <= 0 {
+		log.Fatal("lockout threshold, delay and window must be positive")
+	}
+
 	log.Println("open database at " + config.Storage)
 
-	if db, err := srv.NewStorage(config.Storage); err != nil {
+	opts := []srv.StorageOption{}
+
+	if len(config.TokenKey) != 0 {
+		opts = append(opts, srv.WithTokenKey([]byte(config.TokenKey)))
+	} else {
+		log.Println("token key is not set: use key kept in " +
+			srv.TokenKeyPath(config.Storage))
+	}
+
+	if db, err := srv.NewStorage(config.Storage, opts...); err != nil {
 		log.Fatal(err)
 	} else {
 		storage = db
 		defer storage.Close()
 	}
 
-	log.Println("use token " + config.Token)
-	api := srv.New(config.Token)
+	log.Println("use token " + srv.RedactToken(config.Token))
+	log.Println("use bot api at " + config.ApiEndpoint)
+	api := srv.New(config.Token,
+		srv.WithEndpoint(config.ApiEndpoint),
+		srv.WithTimeout(time.Duration(config.ApiTimeout)*time.Second))
+
+	// stop gracefully on interruption
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
 
-	if me, err := api.GetMe(); err != nil {
+	if me, err := api.GetMe(ctx); err != nil {
 		log.Fatal("exit: ", err)
 	} else {
 		log.Println("Telegram Bot API: /getMe:")
@@ -66,11 +136,38 @@ func main() {
 		log.Println("    Username:", me.UserName)
 	}
 
-	log.Fatal((&srv.TelePyth{
-		Api:        api,
-		Storage:    storage,
-		Polling:    true,
-		Timeout:    30,
-		MetricsLog: *metricsLog,
-	}).Serve())
+	if !config.Polling && len(config.WebhookURL) == 0 {
+		log.Println("webhook url is not set: fall back to polling")
+		config.Polling = true
+	}
+
+	var lockout *srv.Lockout
+
+	if config.Lockout.Enabled {
+		lockout = srv.NewLockout()
+		lockout.Threshold = config.Lockout.Threshold
+		lockout.Delay = time.Duration(config.Lockout.Delay) * time.Second
+		lockout.Window = time.Duration(config.Lockout.Window) * time.Hour
+	}
+
+	err := (&srv.TelePyth{
+		Api:            api,
+		Storage:        storage,
+		Polling:        config.Polling,
+		Timeout:        config.Timeout,
+		WebhookURL:     config.WebhookURL,
+		WebhookCert:    config.WebhookCert,
+		WebhookSecret:  config.WebhookSecret,
+		MetricsLog:     config.MetricsLog,
+		AdminToken:     config.AdminToken,
+		TrustedProxies: config.TrustedProxies,
+		RotationGrace:  time.Duration(config.RotationGrace) * time.Hour,
+		Lockout:        lockout,
+	}).Serve(ctx)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("done.")
 }
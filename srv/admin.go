@@ -0,0 +1,127 @@
+package srv
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsAdmin checks whether request is authorized with administrative token in
+// header `Authorization: Bearer <token>`. Wrong token counts as failed
+// authentication and address which is locked out is never authorized.
+func (t *TelePyth) IsAdmin(req *http.Request) bool {
+	if len(t.AdminToken) == 0 {
+		return false
+	}
+
+	addr := t.clientIP(req).String()
+
+	if t.Lockout != nil && t.Lockout.Locked(addr, time.Now()) > 0 {
+		log.Println("address", addr, "is locked out")
+		return false
+	}
+
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(t.AdminToken)) == 1 {
+		return true
+	}
+
+	log.Println("admin token from", addr, "is rejected")
+
+	if t.Lockout == nil {
+		// failure is not counted
+	} else if delay := t.Lockout.Fail(addr, time.Now()); delay > 0 {
+		log.Println("address", addr, "is locked out for", delay)
+	}
+
+	return false
+}
+
+// HandleDeadLettersRequest lets operator inspect undeliverable notifications
+// and either requeue or drop them.
+//
+//	GET    /api/admin/dead-letters/      list notifications
+//	POST   /api/admin/dead-letters/<id>  move notification back to outbox
+//	DELETE /api/admin/dead-letters/<id>  drop notification
+func (t *TelePyth) HandleDeadLettersRequest(w http.ResponseWriter, req *http.Request) {
+	if !t.IsAdmin(req) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	suffix := strings.TrimPrefix(req.URL.Path, "/api/admin/dead-letters/")
+
+	if len(suffix) == 0 && req.Method == "GET" {
+		notifications, err := t.Storage.SelectDeadNotifications(req.Context())
+
+		if err != nil {
+			log.Println("error:", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(notifications)
+		return
+	}
+
+	id, err := strconv.ParseUint(suffix, 10, 64)
+
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case "POST":
+		err = t.Storage.RequeueNotification(req.Context(), id)
+	case "DELETE":
+		err = t.Storage.DeleteDeadNotification(req.Context(), id)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Println("admin:", req.Method, "dead notification", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLockoutsRequest lets operator see counters of failed authentications
+// and addresses which are locked out, and lift lockout of address.
+//
+//	GET    /api/admin/lockouts/        show counters and locked addresses
+//	DELETE /api/admin/lockouts/<addr>  lift lockout of address
+func (t *TelePyth) HandleLockoutsRequest(w http.ResponseWriter, req *http.Request) {
+	if !t.IsAdmin(req) || t.Lockout == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	addr := strings.TrimPrefix(req.URL.Path, "/api/admin/lockouts/")
+
+	switch {
+	case len(addr) == 0 && req.Method == "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t.Lockout.Stats(time.Now()))
+	case len(addr) != 0 && req.Method == "DELETE":
+		if !t.Lockout.Clear(addr) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		log.Println("admin: clear lockout of", addr)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -2,12 +2,19 @@ package srv
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
+	neturl "net/url"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/daskol/telepyth/srv/format"
 )
 
 type User struct {
@@ -30,6 +37,8 @@ type Chat struct {
 type Message struct {
 	MessageId      int    `json:"message_id,omitempty"`
 	From           User   `json:"from,omitempty"`
+	Chat           Chat   `json:"chat,omitempty"`
+	Date           int    `json:"date,omitempty"`
 	Text           string `json:"text,omitempty"`
 	FrowardedFrom  User   `json:"forwarded_from,omitempty"`
 	Caption        string `json:"caption,omitempty"`
@@ -46,51 +55,202 @@ type Update struct {
 	EditedChanelPost Message `json:"edited_chanel_post,omitempty"`
 }
 
+// ResponseMe is a response of getMe method with decoded result.
 type ResponseMe struct {
 	Ok     bool `json:"ok,omitempty"`
 	Result User `json:"result,omitempty"`
 }
 
+// ResponseUpdates is a response of getUpdates method with decoded result.
 type ResponseUpdates struct {
 	Ok     bool     `json:"ok,omitempty"`
 	Result []Update `json:"result,omitempty"`
 }
 
+// ResponseParameters describes why a request was unsuccessful.
+type ResponseParameters struct {
+	MigrateToChatId int `json:"migrate_to_chat_id,omitempty"`
+	RetryAfter      int `json:"retry_after,omitempty"`
+}
+
+// Response is an envelope of every Bot API response. Result is decoded
+// lazily since its type depends on method.
+type Response struct {
+	Ok          bool                `json:"ok"`
+	Result      json.RawMessage     `json:"result,omitempty"`
+	ErrorCode   int                 `json:"error_code,omitempty"`
+	Description string              `json:"description,omitempty"`
+	Parameters  *ResponseParameters `json:"parameters,omitempty"`
+}
+
+// APIError is returned by every method of TelegramBotApi when Bot API
+// rejects request.
+type APIError struct {
+	Method          string
+	Code            int
+	Description     string
+	RetryAfter      int
+	MigrateToChatId int
+}
+
+func (e *APIError) Error() string {
+	return "telegram: " + e.Method + ": [" + strconv.Itoa(e.Code) + "] " +
+		e.Description
+}
+
+// Temporary reports whether the same request could succeed later.
+func (e *APIError) Temporary() bool {
+	return e.Code == http.StatusTooManyRequests || e.Code >= 500
+}
+
+// DefaultEndpoint is the base URL of the public Telegram Bot API server.
+const DefaultEndpoint = "https://api.telegram.org"
+
+// DefaultTimeout is the default time limit for a single Bot API request.
+const DefaultTimeout = 30 * time.Second
+
 type TelegramBotApi struct {
-	token string
+	token    string
+	endpoint string
+	client   *http.Client
+	timeout  time.Duration
 }
 
-func New(token string) *TelegramBotApi {
-	return &TelegramBotApi{token}
+// Option configures TelegramBotApi on construction.
+type Option func(*TelegramBotApi)
+
+// WithEndpoint sets base URL of Bot API server. It is useful in order to use
+// self-hosted Bot API server or a local stand-in in tests.
+func WithEndpoint(endpoint string) Option {
+	return func(t *TelegramBotApi) {
+		if len(endpoint) != 0 {
+			t.endpoint = strings.TrimSuffix(endpoint, "/")
+		}
+	}
+}
+
+// WithHTTPClient sets HTTP client which is used to perform requests.
+func WithHTTPClient(client *http.Client) Option {
+	return func(t *TelegramBotApi) {
+		if client != nil {
+			t.client = client
+		}
+	}
+}
+
+// WithTimeout sets time limit for every Bot API request. Long polling
+// requests are given extra time equal to polling timeout.
+func WithTimeout(timeout time.Duration) Option {
+	return func(t *TelegramBotApi) {
+		if timeout > 0 {
+			t.timeout = timeout
+		}
+	}
+}
+
+func New(token string, opts ...Option) *TelegramBotApi {
+	t := &TelegramBotApi{
+		token:    token,
+		endpoint: DefaultEndpoint,
+		client:   http.DefaultClient,
+		timeout:  DefaultTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
 }
 
 func (t *TelegramBotApi) GetToken() string {
 	return t.token
 }
 
-func (t *TelegramBotApi) GetMe() (*User, error) {
-	url := "https://api.telegram.org/bot" + t.token + "/getMe"
-	res, err := http.Post(url, "application/json", nil)
+// call performs request to Bot API method with content of given type and
+// decodes result of method into result if it is not nil. Request is cancelled
+// if it takes longer than timeout or if context is cancelled.
+func (t *TelegramBotApi) call(ctx context.Context, method, contentType string, content io.Reader, timeout time.Duration, result interface{}) error {
+	url := t.endpoint + "/bot" + t.token + "/" + method
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, content)
 
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	res, err := t.client.Do(req)
+
+	// transport errors contain URL which contains bot token
+	var urlErr *neturl.Error
+
+	if errors.As(err, &urlErr) {
+		urlErr.URL = redact(urlErr.URL, t.token)
+	}
+
+	if err != nil {
+		return err
 	}
 
 	defer res.Body.Close()
 
-	body := &ResponseMe{}
+	body := &Response{}
 	decoder := json.NewDecoder(res.Body)
 
 	if err := decoder.Decode(body); err != nil {
+		if res.StatusCode != http.StatusOK {
+			return &APIError{
+				Method:      method,
+				Code:        res.StatusCode,
+				Description: http.StatusText(res.StatusCode),
+			}
+		}
+
+		return err
+	}
+
+	if !body.Ok {
+		apiErr := &APIError{
+			Method:      method,
+			Code:        body.ErrorCode,
+			Description: body.Description,
+		}
+
+		if apiErr.Code == 0 {
+			apiErr.Code = res.StatusCode
+		}
+
+		if body.Parameters != nil {
+			apiErr.RetryAfter = body.Parameters.RetryAfter
+			apiErr.MigrateToChatId = body.Parameters.MigrateToChatId
+		}
+
+		return apiErr
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body.Result, result)
+}
+
+func (t *TelegramBotApi) GetMe(ctx context.Context) (*User, error) {
+	user := &User{}
+
+	if err := t.call(ctx, "getMe", "application/json", nil, t.timeout, user); err != nil {
 		return nil, err
-	} else if body.Result.Id == 0 {
-		return &body.Result, errors.New("token `" + t.token + "` is wrong")
+	} else if user.Id == 0 {
+		return user, errors.New("token `" + RedactToken(t.token) + "` is wrong")
 	} else {
-		return &body.Result, nil
+		return user, nil
 	}
 }
 
-func (t *TelegramBotApi) GetUpdates(offset, limit, timeout int, allowedUpdates []string) ([]Update, error) {
+func (t *TelegramBotApi) GetUpdates(ctx context.Context, offset, limit, timeout int, allowedUpdates []string) ([]Update, error) {
 	content := new(bytes.Buffer)
 	encoder := json.NewEncoder(content)
 	params := &getUpdates{offset, limit, timeout, allowedUpdates}
@@ -99,23 +259,15 @@ func (t *TelegramBotApi) GetUpdates(offset, limit, timeout int, allowedUpdates [
 		return nil, err
 	}
 
-	url := "https://api.telegram.org/bot" + t.token + "/getUpdates"
-	res, err := http.Post(url, "application/json", content)
+	updates := []Update{}
+	deadline := t.timeout + time.Duration(timeout)*time.Second
+	err := t.call(ctx, "getUpdates", "application/json", content, deadline, &updates)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer res.Body.Close()
-
-	body := &ResponseUpdates{}
-	decoder := json.NewDecoder(res.Body)
-
-	if err := decoder.Decode(body); err != nil {
-		return nil, err
-	}
-
-	return body.Result, nil
+	return updates, nil
 }
 
 type getUpdates struct {
@@ -125,123 +277,443 @@ type getUpdates struct {
 	AllowedUpdates []string `json:"allowed_updates,omitempty"`
 }
 
+// MessageEntity is a special entity in text (e.g. bold text or link). It is
+// used instead of parse mode.
+type MessageEntity = format.MessageEntity
+
 type SendMessage struct {
-	ChatId                int    `json:"chat_id"`
-	Text                  string `json:"text"`
-	ParseMode             string `json:"parse_mode,omitempty"`
-	DisableWebPagePreview bool   `json:"disable_web_page_preview,omitempty"`
-	DisableNotification   bool   `json:"disable_notification,omitempty"`
+	ChatId                int             `json:"chat_id"`
+	Text                  string          `json:"text"`
+	ParseMode             string          `json:"parse_mode,omitempty"`
+	Entities              []MessageEntity `json:"entities,omitempty"`
+	DisableWebPagePreview bool            `json:"disable_web_page_preview,omitempty"`
+	DisableNotification   bool            `json:"disable_notification,omitempty"`
+	ProtectContent        bool            `json:"protect_content,omitempty"`
+	ReplyToMessageId      int             `json:"reply_to_message_id,omitempty"`
 }
 
-func (s *SendMessage) To(t *TelegramBotApi) error {
+func (s *SendMessage) To(ctx context.Context, t *TelegramBotApi) error {
+	_, err := s.Send(ctx, t)
+	return err
+}
+
+func (s *SendMessage) Send(ctx context.Context, t *TelegramBotApi) (*Message, error) {
 	content := new(bytes.Buffer)
 	encoder := json.NewEncoder(content)
 
 	if err := encoder.Encode(s); err != nil {
-		return err
+		return nil, err
 	}
 
-	url := "https://api.telegram.org/bot" + t.token + "/sendMessage"
-	res, err := http.Post(url, "application/json", content)
+	msg := &Message{}
+	err := t.call(ctx, "sendMessage", "application/json", content, t.timeout, msg)
 
 	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *SendMessage) Recipient() int {
+	return s.ChatId
+}
+
+// inputFile is a file which is uploaded in multipart/form-data request.
+type inputFile struct {
+	Field       string
+	Name        string
+	ContentType string
+	Content     io.Reader
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// upload performs request to Bot API method with files in multipart/form-data
+// request. The rest of parameters are taken from JSON representation of
+// params.
+func (t *TelegramBotApi) upload(ctx context.Context, method string, params interface{}, files []inputFile, result interface{}) error {
+	values := map[string]json.RawMessage{}
+
+	if bytes, err := json.Marshal(params); err != nil {
+		return err
+	} else if err := json.Unmarshal(bytes, &values); err != nil {
 		return err
 	}
 
-	defer res.Body.Close()
+	for _, file := range files {
+		delete(values, file.Field)
+	}
 
-	return nil
+	var b bytes.Buffer
+
+	w := multipart.NewWriter(&b)
+
+	for key, value := range values {
+		// strings are passed as is while the rest is passed serialized
+		field := string(value)
+
+		if err := json.Unmarshal(value, &field); err != nil {
+			field = string(value)
+		}
+
+		if err := w.WriteField(key, field); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="`+
+			quoteEscaper.Replace(file.Field)+`"; filename="`+
+			quoteEscaper.Replace(file.Name)+`"`)
+
+		if len(file.ContentType) != 0 {
+			header.Set("Content-Type", file.ContentType)
+		} else {
+			header.Set("Content-Type", "application/octet-stream")
+		}
+
+		part, err := w.CreatePart(header)
+
+		if err != nil {
+			return err
+		}
+
+		// rewind file content in case of repeated request
+		if seeker, ok := file.Content.(io.Seeker); ok {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+
+		if _, err := io.Copy(part, file.Content); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return t.call(ctx, method, w.FormDataContentType(), &b, t.timeout, result)
 }
 
 type SendPhoto struct {
 	ChatId int `json:"chat_id"`
 
 	// Photo is type of either string or io.Writer in case of uploading
-	Photo               interface{} `json:"photo,omitempty"`
-	Caption             string      `json:"caption,omitempty"`
-	DisableNotification bool        `json:"disable_notification,omitempty"`
-	ReplyToMessageId    int         `json:"reply_to_message_id,omitempty"`
-	ReplyMarkup         interface{} `json:"reply_markup"`
+	Photo               interface{}     `json:"photo,omitempty"`
+	FileName            string          `json:"-"`
+	ContentType         string          `json:"-"`
+	Caption             string          `json:"caption,omitempty"`
+	ParseMode           string          `json:"parse_mode,omitempty"`
+	CaptionEntities     []MessageEntity `json:"caption_entities,omitempty"`
+	DisableNotification bool            `json:"disable_notification,omitempty"`
+	ProtectContent      bool            `json:"protect_content,omitempty"`
+	ReplyToMessageId    int             `json:"reply_to_message_id,omitempty"`
+	ReplyMarkup         interface{}     `json:"reply_markup,omitempty"`
+}
+
+func (s *SendPhoto) To(ctx context.Context, t *TelegramBotApi) error {
+	_, err := s.Send(ctx, t)
+	return err
 }
 
-func (s *SendPhoto) To(t *TelegramBotApi) error {
+func (s *SendPhoto) Send(ctx context.Context, t *TelegramBotApi) (*Message, error) {
 	switch s.Photo.(type) {
 	case io.Reader:
-		return s.NewTo(t)
+		return s.NewTo(ctx, t)
 	case string:
-		return s.ExistingTo(t)
+		return s.ExistingTo(ctx, t)
 	default:
-		return errors.New("wrong type of SendPhoto.Photo")
+		return nil, errors.New("wrong type of SendPhoto.Photo")
 	}
 }
 
-func (s *SendPhoto) ExistingTo(t *TelegramBotApi) error {
+func (s *SendPhoto) Recipient() int {
+	return s.ChatId
+}
+
+func (s *SendPhoto) ExistingTo(ctx context.Context, t *TelegramBotApi) (*Message, error) {
 	content := new(bytes.Buffer)
 	encoder := json.NewEncoder(content)
 
 	if err := encoder.Encode(s); err != nil {
-		return err
+		return nil, err
 	}
 
-	url := "https://api.telegram.org/bot" + t.token + "/sendMessage"
-	res, err := http.Post(url, "application/json", content)
+	msg := &Message{}
+	err := t.call(ctx, "sendPhoto", "application/json", content, t.timeout, msg)
 
-	if res != nil {
-		return err
+	if err != nil {
+		return nil, err
 	}
 
-	defer res.Body.Close()
-
-	return nil
+	return msg, nil
 }
 
-func (s *SendPhoto) NewTo(t *TelegramBotApi) error {
-	var b bytes.Buffer
+func (s *SendPhoto) NewTo(ctx context.Context, t *TelegramBotApi) (*Message, error) {
+	name := s.FileName
 
-	w := multipart.NewWriter(&b)
+	if len(name) == 0 {
+		name = "figure.png"
+	}
 
-	if err := w.WriteField("chat_id", strconv.Itoa(s.ChatId)); err != nil {
-		return err
+	files := []inputFile{{"photo", name, s.ContentType, s.Photo.(io.Reader)}}
+	msg := &Message{}
+
+	if err := t.upload(ctx, "sendPhoto", s, files, msg); err != nil {
+		return nil, err
 	}
 
-	if len(s.Caption) > 0 {
-		if err := w.WriteField("caption", s.Caption); err != nil {
-			return err
+	return msg, nil
+}
+
+type SendDocument struct {
+	ChatId int `json:"chat_id"`
+
+	// Document is type of either string or io.Reader in case of uploading.
+	// File name and content type are used for uploading only.
+	Document            interface{}     `json:"document,omitempty"`
+	FileName            string          `json:"-"`
+	ContentType         string          `json:"-"`
+	Caption             string          `json:"caption,omitempty"`
+	ParseMode           string          `json:"parse_mode,omitempty"`
+	CaptionEntities     []MessageEntity `json:"caption_entities,omitempty"`
+	DisableNotification bool            `json:"disable_notification,omitempty"`
+	ProtectContent      bool            `json:"protect_content,omitempty"`
+	ReplyToMessageId    int             `json:"reply_to_message_id,omitempty"`
+	ReplyMarkup         interface{}     `json:"reply_markup,omitempty"`
+}
+
+func (s *SendDocument) To(ctx context.Context, t *TelegramBotApi) error {
+	_, err := s.Send(ctx, t)
+	return err
+}
+
+func (s *SendDocument) Send(ctx context.Context, t *TelegramBotApi) (*Message, error) {
+	msg := &Message{}
+
+	switch document := s.Document.(type) {
+	case io.Reader:
+		name := s.FileName
+
+		if len(name) == 0 {
+			name = "document"
+		}
+
+		files := []inputFile{{"document", name, s.ContentType, document}}
+
+		if err := t.upload(ctx, "sendDocument", s, files, msg); err != nil {
+			return nil, err
+		}
+	case string:
+		content := new(bytes.Buffer)
+		encoder := json.NewEncoder(content)
+
+		if err := encoder.Encode(s); err != nil {
+			return nil, err
+		}
+
+		err := t.call(ctx, "sendDocument", "application/json", content, t.timeout, msg)
+
+		if err != nil {
+			return nil, err
 		}
+	default:
+		return nil, errors.New("wrong type of SendDocument.Document")
 	}
 
-	photo, err := w.CreateFormFile("photo", "figure.png")
+	return msg, nil
+}
 
-	if err != nil {
-		return err
+func (s *SendDocument) Recipient() int {
+	return s.ChatId
+}
+
+// InputMedia is an item of media group. If File is set then it is uploaded
+// along with media group and Media is ignored.
+type InputMedia struct {
+	Type            string          `json:"type"`
+	Media           string          `json:"media"`
+	Caption         string          `json:"caption,omitempty"`
+	ParseMode       string          `json:"parse_mode,omitempty"`
+	CaptionEntities []MessageEntity `json:"caption_entities,omitempty"`
+
+	File        io.Reader `json:"-"`
+	FileName    string    `json:"-"`
+	ContentType string    `json:"-"`
+}
+
+// SendMediaGroup sends from 2 to 10 photos or documents as an album. Photos
+// and documents could not be mixed in the same album.
+type SendMediaGroup struct {
+	ChatId              int          `json:"chat_id"`
+	Media               []InputMedia `json:"media"`
+	DisableNotification bool         `json:"disable_notification,omitempty"`
+	ProtectContent      bool         `json:"protect_content,omitempty"`
+	ReplyToMessageId    int          `json:"reply_to_message_id,omitempty"`
+}
+
+func (s *SendMediaGroup) To(ctx context.Context, t *TelegramBotApi) error {
+	_, err := s.Send(ctx, t)
+	return err
+}
+
+// Send sends media group and returns its first message.
+func (s *SendMediaGroup) Send(ctx context.Context, t *TelegramBotApi) (*Message, error) {
+	if msgs, err := s.SendAll(ctx, t); err != nil {
+		return nil, err
+	} else if len(msgs) == 0 {
+		return nil, errors.New("media group is empty")
+	} else {
+		return &msgs[0], nil
 	}
+}
 
-	if _, err := io.Copy(photo, s.Photo.(io.Reader)); err != nil {
-		return err
+// SendAll sends media group and returns all its messages.
+func (s *SendMediaGroup) SendAll(ctx context.Context, t *TelegramBotApi) ([]Message, error) {
+	params := *s
+	params.Media = make([]InputMedia, len(s.Media))
+	files := []inputFile{}
+
+	for i, media := range s.Media {
+		if media.File != nil {
+			field := "file" + strconv.Itoa(i)
+			media.Media = "attach://" + field
+			files = append(files, inputFile{
+				field, media.FileName, media.ContentType, media.File,
+			})
+		}
+
+		params.Media[i] = media
 	}
 
-	//  TODO: skip rest of arguments
+	msgs := []Message{}
 
-	if err := w.Close(); err != nil {
-		return err
+	if err := t.upload(ctx, "sendMediaGroup", &params, files, &msgs); err != nil {
+		return nil, err
 	}
 
-	url := "https://api.telegram.org/bot" + t.token + "/sendPhoto"
-	req, err := http.NewRequest("POST", url, &b)
+	return msgs, nil
+}
+
+func (s *SendMediaGroup) Recipient() int {
+	return s.ChatId
+}
+
+type EditMessageText struct {
+	ChatId                int             `json:"chat_id"`
+	MessageId             int             `json:"message_id"`
+	Text                  string          `json:"text"`
+	ParseMode             string          `json:"parse_mode,omitempty"`
+	Entities              []MessageEntity `json:"entities,omitempty"`
+	DisableWebPagePreview bool            `json:"disable_web_page_preview,omitempty"`
+}
+
+func (s *EditMessageText) To(ctx context.Context, t *TelegramBotApi) error {
+	_, err := s.Send(ctx, t)
+	return err
+}
+
+func (s *EditMessageText) Send(ctx context.Context, t *TelegramBotApi) (*Message, error) {
+	content := new(bytes.Buffer)
+	encoder := json.NewEncoder(content)
+
+	if err := encoder.Encode(s); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{}
+	err := t.call(ctx, "editMessageText", "application/json", content, t.timeout, msg)
 
 	if err != nil {
-		return nil
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *EditMessageText) Recipient() int {
+	return s.ChatId
+}
+
+type EditMessageCaption struct {
+	ChatId          int             `json:"chat_id"`
+	MessageId       int             `json:"message_id"`
+	Caption         string          `json:"caption"`
+	ParseMode       string          `json:"parse_mode,omitempty"`
+	CaptionEntities []MessageEntity `json:"caption_entities,omitempty"`
+}
+
+func (s *EditMessageCaption) To(ctx context.Context, t *TelegramBotApi) error {
+	_, err := s.Send(ctx, t)
+	return err
+}
+
+func (s *EditMessageCaption) Send(ctx context.Context, t *TelegramBotApi) (*Message, error) {
+	content := new(bytes.Buffer)
+	encoder := json.NewEncoder(content)
+
+	if err := encoder.Encode(s); err != nil {
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", w.FormDataContentType())
-	cli := &http.Client{}
-	res, err := cli.Do(req)
+	msg := &Message{}
+	err := t.call(ctx, "editMessageCaption", "application/json", content, t.timeout, msg)
 
 	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func (s *EditMessageCaption) Recipient() int {
+	return s.ChatId
+}
+
+// SetWebhook asks Bot API to deliver updates to URL. Certificate is uploaded
+// if it is set in order to use self-signed certificate.
+type SetWebhook struct {
+	Url                string    `json:"url"`
+	Certificate        io.Reader `json:"-"`
+	MaxConnections     int       `json:"max_connections,omitempty"`
+	AllowedUpdates     []string  `json:"allowed_updates,omitempty"`
+	DropPendingUpdates bool      `json:"drop_pending_updates,omitempty"`
+	SecretToken        string    `json:"secret_token,omitempty"`
+}
+
+func (s *SetWebhook) To(ctx context.Context, t *TelegramBotApi) error {
+	if s.Certificate != nil {
+		files := []inputFile{{"certificate", "certificate.pem", "", s.Certificate}}
+		return t.upload(ctx, "setWebhook", s, files, nil)
+	}
+
+	content := new(bytes.Buffer)
+	encoder := json.NewEncoder(content)
+
+	if err := encoder.Encode(s); err != nil {
 		return err
 	}
 
-	defer res.Body.Close()
+	return t.call(ctx, "setWebhook", "application/json", content, t.timeout, nil)
+}
+
+// DeleteWebhook asks Bot API to stop delivery of updates to webhook in order
+// to switch back to long polling.
+type DeleteWebhook struct {
+	DropPendingUpdates bool `json:"drop_pending_updates,omitempty"`
+}
+
+func (s *DeleteWebhook) To(ctx context.Context, t *TelegramBotApi) error {
+	content := new(bytes.Buffer)
+	encoder := json.NewEncoder(content)
+
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
 
-	return nil
+	return t.call(ctx, "deleteWebhook", "application/json", content, t.timeout, nil)
 }
@@ -0,0 +1,129 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTelegramBotApiEndpoint(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/bot42:token/getMe" {
+			t.Error("wrong path: ", req.URL.Path)
+		}
+
+		w.Write([]byte(`{"ok": true, "result": {"id": 42, ` +
+			`"first_name": "TelePyth", "username": "telepyth_bot"}}`))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	api := New("42:token",
+		WithEndpoint(server.URL+"/"),
+		WithHTTPClient(server.Client()),
+		WithTimeout(time.Second))
+
+	me, err := api.GetMe(context.Background())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if me.Id != 42 || me.UserName != "telepyth_bot" {
+		t.Error("wrong result: ", me)
+	}
+}
+
+func TestTelegramBotApiTimeout(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	api := New("42:token",
+		WithEndpoint(server.URL),
+		WithTimeout(50*time.Millisecond))
+
+	if _, err := api.GetMe(context.Background()); err == nil {
+		t.Error("request should be timed out")
+	} else if strings.Contains(err.Error(), "42:token") {
+		t.Error("bot token is not redacted: ", err)
+	}
+}
+
+func TestTelegramBotApiError(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"ok": false, "error_code": 429, ` +
+			`"description": "Too Many Requests: retry after 7", ` +
+			`"parameters": {"retry_after": 7}}`))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	api := New("42:token", WithEndpoint(server.URL))
+	err := (&SendMessage{ChatId: 1, Text: "Hello, World!"}).To(context.Background(), api)
+
+	var apiErr *APIError
+
+	if !errors.As(err, &apiErr) {
+		t.Fatal("wrong error: ", err)
+	}
+
+	if apiErr.Method != "sendMessage" || apiErr.Code != 429 ||
+		apiErr.RetryAfter != 7 || !apiErr.Temporary() {
+		t.Error("wrong error: ", apiErr)
+	}
+}
+
+func TestSendDocument(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseMultipartForm(1024); err != nil {
+			t.Fatal(err)
+		}
+
+		if chatId := req.FormValue("chat_id"); chatId != "1" {
+			t.Error("wrong chat id: ", chatId)
+		}
+
+		if caption := req.FormValue("caption"); caption != "Results" {
+			t.Error("wrong caption: ", caption)
+		}
+
+		header := req.MultipartForm.File["document"][0]
+
+		if header.Filename != "results.csv" ||
+			header.Header.Get("Content-Type") != "text/csv" {
+			t.Error("wrong document: ", header.Filename, header.Header)
+		}
+
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 2}}`))
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	msg, err := (&SendDocument{
+		ChatId:      1,
+		Document:    strings.NewReader("epoch,loss\n1,0.41\n"),
+		FileName:    "results.csv",
+		ContentType: "text/csv",
+		Caption:     "Results",
+	}).Send(context.Background(), New("42:token", WithEndpoint(server.URL)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.MessageId != 2 {
+		t.Error("wrong message: ", msg)
+	}
+}
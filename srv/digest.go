@@ -0,0 +1,131 @@
+package srv
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// IsDigest reports whether non-urgent notifications are collected into
+// digest.
+func (p *Preferences) IsDigest() bool {
+	return p.DigestInterval > 0 || p.DigestDaily
+}
+
+// NextDigest returns a moment when digest which is started at the given
+// moment should be sent. Daily digest is sent in time zone of user.
+func (p *Preferences) NextDigest(since time.Time) time.Time {
+	switch {
+	case p.DigestDaily:
+		next := atClock(since.In(p.Location()), p.DigestAt)
+
+		if !next.After(since) {
+			next = atClock(next.AddDate(0, 0, 1), p.DigestAt)
+		}
+
+		return next
+	case p.DigestInterval > 0:
+		return since.Add(p.DigestInterval)
+	default:
+		return since
+	}
+}
+
+// DescribeDigest describes digest settings to user.
+func (p *Preferences) DescribeDigest() string {
+	switch {
+	case p.DigestDaily:
+		return "Notifications are collected into digest which is sent daily at " +
+			formatClock(p.DigestAt) + " " + p.zoneName() + "."
+	case p.DigestInterval > 0:
+		return "Notifications are collected into digest which is sent every " +
+			p.DigestInterval.String() + "."
+	default:
+		return "Notifications are sent immediately."
+	}
+}
+
+// minDigestInterval is the shortest interval between digests.
+const minDigestInterval = time.Minute
+
+// parseDigest parses argument of /digest command. It is either `off`,
+// interval in minutes or in Go notation (e.g. `30` or `2h`) or time of day
+// (e.g. `09:00`).
+func parseDigest(arg string, p *Preferences) bool {
+	p.DigestInterval = 0
+	p.DigestDaily = false
+	p.DigestAt = 0
+
+	if arg = strings.ToLower(arg); arg == "off" {
+		return true
+	} else if at, ok := parseClock(arg); ok {
+		p.DigestDaily = true
+		p.DigestAt = at
+		return true
+	} else if minutes, err := strconv.Atoi(arg); err == nil {
+		p.DigestInterval = time.Duration(minutes) * time.Minute
+	} else if interval, err := time.ParseDuration(arg); err == nil {
+		p.DigestInterval = interval
+	}
+
+	return p.DigestInterval >= minDigestInterval
+}
+
+// digestible reports whether notification could be collected into digest.
+// Urgent notifications, replies and attachments are sent on their own.
+func (n *Notification) digestible() bool {
+	return n.priority() != PriorityUrgent && n.ReplyToMessageId == 0 &&
+		len(n.Attachments) == 0
+}
+
+// digestSummaries collects held notifications of user into summaries. Texts
+// in different parse modes could not be mixed, so there is a summary for
+// every parse mode.
+func digestSummaries(held []*Notification) []*Notification {
+	summaries := []*Notification{}
+	texts := map[*Notification][]string{}
+	byParseMode := map[string]*Notification{}
+
+	for _, n := range held {
+		summary, ok := byParseMode[n.ParseMode]
+
+		if !ok {
+			summary = &Notification{
+				Token:               n.Token,
+				ChatId:              n.ChatId,
+				ParseMode:           n.ParseMode,
+				LongMessage:         n.LongMessage,
+				DisableNotification: true,
+				CreatedAt:           time.Now(),
+				NextAttempt:         time.Now(),
+			}
+
+			byParseMode[n.ParseMode] = summary
+			summaries = append(summaries, summary)
+		}
+
+		// summary is silent only if every notification is silent
+		summary.DisableNotification = summary.DisableNotification &&
+			n.DisableNotification
+
+		// summary is protected if any notification is protected
+		summary.ProtectContent = summary.ProtectContent || n.ProtectContent
+		summary.DisableWebPagePreview = summary.DisableWebPagePreview ||
+			n.DisableWebPagePreview
+		summary.Digest = append(summary.Digest, n.ReceiptId)
+		texts[summary] = append(texts[summary], n.Text)
+	}
+
+	for _, summary := range summaries {
+		header := "Digest of " + strconv.Itoa(len(summary.Digest)) +
+			" notifications"
+
+		if len(summary.Digest) == 1 {
+			header = "Digest of 1 notification"
+		}
+
+		summary.Text = header + "\n\n" + strings.Join(texts[summary], "\n\n")
+	}
+
+	return summaries
+}
@@ -0,0 +1,132 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreferencesNextDigest(t *testing.T) {
+	prefs := &Preferences{}
+	since := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	if !parseDigest("09:00", prefs) {
+		t.Fatal("daily digest is not parsed")
+	} else if next := prefs.NextDigest(since); !next.Equal(since.Add(22*time.Hour + 30*time.Minute)) {
+		t.Error("wrong daily digest: ", next)
+	}
+
+	if !parseDigest("30", prefs) || prefs.DigestDaily {
+		t.Fatal("interval is not parsed")
+	} else if next := prefs.NextDigest(since); !next.Equal(since.Add(30 * time.Minute)) {
+		t.Error("wrong digest: ", next)
+	}
+
+	if parseDigest("10s", prefs) {
+		t.Error("too short interval is accepted")
+	}
+
+	if !parseDigest("off", prefs) || prefs.IsDigest() {
+		t.Error("digest is not turned off")
+	}
+}
+
+func TestDigest(t *testing.T) {
+	messages := make(chan SendMessage, 10)
+
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		msg := SendMessage{}
+		json.NewDecoder(req.Body).Decode(&msg)
+		messages <- msg
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	ctx := context.Background()
+	user := &User{Id: 1}
+
+	err := telepyth.Storage.UpdatePreferences(ctx, user, func(p *Preferences) {
+		p.DigestInterval = time.Hour
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func(body string) *Receipt {
+		req := httptest.NewRequest("POST", "/api/notify", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		telepyth.HandleNotifyRequest(rec, req)
+
+		receipt := &Receipt{}
+
+		if err := json.NewDecoder(rec.Body).Decode(receipt); err != nil {
+			t.Fatal(err)
+		}
+
+		return receipt
+	}
+
+	if receipt := notify(`{"text": "run 1 is done"}`); receipt.State != StateHeld {
+		t.Error("notification is not held: ", receipt)
+	}
+
+	notify(`{"text": "run 2 is done", "priority": "low"}`)
+
+	// urgent notification is sent immediately
+	if receipt := notify(`{"text": "sweep failed", "priority": "urgent"}`); receipt.State != StateSent {
+		t.Error("urgent notification is not sent: ", receipt)
+	} else if msg := <-messages; msg.Text != "sweep failed" {
+		t.Error("wrong message: ", msg.Text)
+	}
+
+	// held notifications are sent at once if digest is turned off
+	err = telepyth.Storage.UpdatePreferences(ctx, user, func(p *Preferences) {
+		p.DigestInterval = 0
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-messages:
+		expected := "Digest of 2 notifications\n\nrun 1 is done\n\nrun 2 is done"
+
+		if msg.Text != expected {
+			t.Error("wrong digest: ", msg.Text)
+		}
+	case <-time.After(time.Second):
+		t.Error("digest is not sent")
+	}
+}
+
+func TestDigestSummaries(t *testing.T) {
+	held := []*Notification{
+		{ChatId: 1, ReceiptId: "a", Text: "run 1 is done", DisableNotification: true},
+		{ChatId: 1, ReceiptId: "b", Text: "run 2 is done", ProtectContent: true},
+		{ChatId: 1, ReceiptId: "c", Text: "see *plot*", ParseMode: "Markdown",
+			DisableWebPagePreview: true},
+	}
+
+	summaries := digestSummaries(held)
+
+	if len(summaries) != 2 {
+		t.Fatal("wrong number of summaries: ", len(summaries))
+	}
+
+	// options are carried over if any notification sets them
+	if s := summaries[0]; !s.ProtectContent || s.DisableWebPagePreview ||
+		s.DisableNotification {
+		t.Error("wrong options of plain summary: ", s)
+	}
+
+	if s := summaries[1]; s.ProtectContent || !s.DisableWebPagePreview {
+		t.Error("wrong options of markdown summary: ", s)
+	}
+}
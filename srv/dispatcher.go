@@ -0,0 +1,298 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Sender is a Bot API request which delivers something to a chat.
+type Sender interface {
+	Recipient() int
+	Send(ctx context.Context, t *TelegramBotApi) (*Message, error)
+}
+
+// Priority defines order in which requests to different chats are sent.
+type Priority int
+
+const (
+	// PriorityBulk is used for announcements to many users.
+	PriorityBulk Priority = iota
+
+	// PriorityNotify is used for notifications sent by users.
+	PriorityNotify
+
+	// PriorityUrgent is used for notifications which users mark as urgent.
+	// They are sent before other notifications but after replies.
+	PriorityUrgent
+
+	// PriorityInteractive is used for replies to bot commands.
+	PriorityInteractive
+)
+
+// Delivery is an outcome of request sent through Dispatcher.
+type Delivery struct {
+	Message *Message
+	Err     error
+}
+
+// Dispatcher is a central queue of outbound requests to Bot API. It paces
+// requests in order to satisfy global and per-chat rate limits of Telegram,
+// waits as long as Bot API asks on flood control, keeps order of requests to
+// the same chat and sends requests of higher priority first.
+type Dispatcher struct {
+	Api *TelegramBotApi
+
+	// GlobalInterval is minimal interval between any two requests.
+	GlobalInterval time.Duration
+
+	// ChatInterval is minimal interval between requests to private chat.
+	ChatInterval time.Duration
+
+	// GroupInterval is minimal interval between requests to group chat.
+	GroupInterval time.Duration
+
+	// MaxRetries is how many times request is repeated on flood control.
+	MaxRetries int
+
+	mu    sync.Mutex
+	seq   uint64
+	next  time.Time
+	chats map[int]*chatQueue
+	wake  chan struct{}
+}
+
+type job struct {
+	ctx      context.Context
+	sender   Sender
+	priority Priority
+	seq      uint64
+	retries  int
+	done     chan Delivery
+}
+
+// before reports whether job should be sent before other one to the same
+// chat.
+func (j *job) before(other *job) bool {
+	if j.priority != other.priority {
+		return j.priority > other.priority
+	}
+
+	return j.seq < other.seq
+}
+
+// chatQueue is a queue of jobs to a chat. The only job to a chat is in
+// flight at any moment in order to keep order of messages.
+type chatQueue struct {
+	jobs []*job
+	busy bool
+	next time.Time
+}
+
+func (q *chatQueue) push(j *job) {
+	idx := len(q.jobs)
+
+	for i, other := range q.jobs {
+		if j.before(other) {
+			idx = i
+			break
+		}
+	}
+
+	q.jobs = append(q.jobs, nil)
+	copy(q.jobs[idx+1:], q.jobs[idx:])
+	q.jobs[idx] = j
+}
+
+func (q *chatQueue) pop() *job {
+	j := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	return j
+}
+
+// NewDispatcher creates dispatcher with rate limits which are recommended by
+// Telegram: 30 messages per second in total, a message per second to a
+// private chat and 20 messages per minute to a group.
+func NewDispatcher(api *TelegramBotApi) *Dispatcher {
+	return &Dispatcher{
+		Api:            api,
+		GlobalInterval: time.Second / 30,
+		ChatInterval:   time.Second,
+		GroupInterval:  3 * time.Second,
+		MaxRetries:     3,
+		chats:          make(map[int]*chatQueue),
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Enqueue puts request into queue and returns channel which receives outcome
+// of the request as soon as it is sent. Request is dropped from queue if
+// context is cancelled before request is sent.
+func (d *Dispatcher) Enqueue(ctx context.Context, sender Sender, priority Priority) <-chan Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.seq += 1
+	j := &job{
+		ctx:      ctx,
+		sender:   sender,
+		priority: priority,
+		seq:      d.seq,
+		done:     make(chan Delivery, 1),
+	}
+
+	q, ok := d.chats[sender.Recipient()]
+
+	if !ok {
+		q = &chatQueue{}
+		d.chats[sender.Recipient()] = q
+	}
+
+	q.push(j)
+	d.notify()
+
+	return j.done
+}
+
+// Send puts request into queue and waits until it is sent or until context
+// is cancelled.
+func (d *Dispatcher) Send(ctx context.Context, sender Sender, priority Priority) (*Message, error) {
+	select {
+	case delivery := <-d.Enqueue(ctx, sender, priority):
+		return delivery.Message, delivery.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Run sends enqueued requests as soon as rate limits allow. It returns when
+// context is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		j, wait := d.pick(time.Now())
+
+		if j != nil {
+			go d.deliver(j)
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+
+		select {
+		case <-d.wake:
+		case <-timeout:
+		case <-ctx.Done():
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// notify wakes up dispatching loop. It should be called under lock.
+func (d *Dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pick finds a job which could be sent right now. Otherwise, it returns time
+// to wait for the next job or negative duration if there is no jobs at all.
+func (d *Dispatcher) pick(now time.Time) (*job, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ready *chatQueue
+	wait := time.Duration(-1)
+
+	for chatId, q := range d.chats {
+		if q.busy {
+			continue
+		}
+
+		// drop requests which are not needed anymore
+		for len(q.jobs) != 0 && q.jobs[0].ctx.Err() != nil {
+			j := q.pop()
+			j.done <- Delivery{nil, j.ctx.Err()}
+		}
+
+		if len(q.jobs) == 0 {
+			// forget idle chat since it does not limit anything anymore
+			if !q.next.After(now) {
+				delete(d.chats, chatId)
+			}
+			continue
+		}
+
+		if delay := q.next.Sub(now); delay > 0 {
+			if wait < 0 || delay < wait {
+				wait = delay
+			}
+			continue
+		}
+
+		if ready == nil || q.jobs[0].before(ready.jobs[0]) {
+			ready = q
+		}
+	}
+
+	if ready == nil {
+		return nil, wait
+	}
+
+	if delay := d.next.Sub(now); delay > 0 {
+		return nil, delay
+	}
+
+	d.next = now.Add(d.GlobalInterval)
+	ready.busy = true
+
+	return ready.pop(), 0
+}
+
+// deliver sends request and either reports its outcome or puts it back to
+// queue if Bot API asks to retry later.
+func (d *Dispatcher) deliver(j *job) {
+	msg, err := j.sender.Send(j.ctx, d.Api)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	chatId := j.sender.Recipient()
+	q := d.chats[chatId]
+	q.busy = false
+
+	if chatId < 0 {
+		q.next = time.Now().Add(d.GroupInterval)
+	} else {
+		q.next = time.Now().Add(d.ChatInterval)
+	}
+
+	var apiErr *APIError
+
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusTooManyRequests &&
+		j.retries < d.MaxRetries {
+		j.retries += 1
+		retryAfter := time.Duration(apiErr.RetryAfter) * time.Second
+
+		if retryAfter > 0 {
+			q.next = time.Now().Add(retryAfter)
+		}
+
+		q.push(j)
+	} else {
+		j.done <- Delivery{msg, err}
+	}
+
+	d.notify()
+}
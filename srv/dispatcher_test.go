@@ -0,0 +1,73 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	var texts []string
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		msg := &SendMessage{}
+		json.NewDecoder(req.Body).Decode(msg)
+
+		mu.Lock()
+		texts = append(texts, msg.Text)
+		flood := len(texts) == 2
+		mu.Unlock()
+
+		if flood {
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok": false, "error_code": 429}`))
+		} else {
+			w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	dispatcher := NewDispatcher(New("42:token", WithEndpoint(server.URL)))
+	dispatcher.ChatInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// enqueue messages before dispatching in order to check priorities
+	first := dispatcher.Enqueue(ctx, &SendMessage{ChatId: 1, Text: "1"}, PriorityBulk)
+	second := dispatcher.Enqueue(ctx, &SendMessage{ChatId: 1, Text: "2"}, PriorityBulk)
+	urgent := dispatcher.Enqueue(ctx, &SendMessage{ChatId: 1, Text: "u"}, PriorityUrgent)
+	reply := dispatcher.Enqueue(ctx, &SendMessage{ChatId: 1, Text: "0"}, PriorityInteractive)
+
+	go dispatcher.Run(ctx)
+
+	for _, ch := range []<-chan Delivery{reply, urgent, first, second} {
+		if delivery := <-ch; delivery.Err != nil {
+			t.Fatal(delivery.Err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// urgent notification is sent after reply, and the second request is
+	// repeated after flood control
+	expected := []string{"0", "u", "u", "1", "2"}
+
+	if len(texts) != len(expected) {
+		t.Fatal("wrong order of requests: ", texts)
+	}
+
+	for i := range expected {
+		if texts[i] != expected[i] {
+			t.Fatal("wrong order of requests: ", texts)
+		}
+	}
+}
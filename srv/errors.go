@@ -0,0 +1,105 @@
+package srv
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// httpError is an error which is reported to client with specific HTTP
+// status.
+type httpError struct {
+	Status int
+	Reason string
+}
+
+func (e *httpError) Error() string {
+	return e.Reason
+}
+
+func errorStatus(status int) error {
+	return &httpError{status, http.StatusText(status)}
+}
+
+// writeError reports error to client. Errors returned by Bot API are mapped
+// on HTTP statuses so client knows that notification was not delivered and
+// why. Other errors mean that Bot API is unavailable.
+func writeError(w http.ResponseWriter, err error) {
+	status, reason := errorReport(w, err)
+	http.Error(w, reason, status)
+}
+
+// writeJSONError reports error to client in the same way as writeError does
+// but in JSON which mimics responses of Bot API.
+func writeJSONError(w http.ResponseWriter, err error) {
+	status, reason := errorReport(w, err)
+	writeJSON(w, status, &Response{
+		Ok:          false,
+		ErrorCode:   status,
+		Description: reason,
+	})
+}
+
+// errorReport returns HTTP status and description of error. It also sets
+// headers which are related to error.
+func errorReport(w http.ResponseWriter, err error) (int, string) {
+	var httpErr *httpError
+	var apiErr *APIError
+
+	switch {
+	case errors.As(err, &httpErr):
+		return httpErr.Status, httpErr.Reason
+	case errors.As(err, &apiErr):
+		log.Println("error:", apiErr)
+
+		if apiErr.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(apiErr.RetryAfter))
+		}
+
+		return apiErrorStatus(apiErr), apiErr.Description
+	default:
+		log.Println("error:", err)
+		return http.StatusServiceUnavailable,
+			http.StatusText(http.StatusServiceUnavailable)
+	}
+}
+
+// apiErrorStatus maps Bot API error on HTTP status which is reported to
+// client.
+func apiErrorStatus(err *APIError) int {
+	switch err.Code {
+	case http.StatusBadRequest:
+		// message is malformed (e.g. bad markup) or chat does not exist
+		return http.StatusUnprocessableEntity
+	case http.StatusForbidden:
+		// bot was blocked or kicked by user
+		return http.StatusForbidden
+	case http.StatusTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		// bot token is wrong or Bot API is broken
+		return http.StatusBadGateway
+	}
+}
+
+// isNotModified reports whether Bot API refuses to edit message since its
+// content is the same.
+func isNotModified(err error) bool {
+	var apiErr *APIError
+
+	return errors.As(err, &apiErr) &&
+		apiErr.Code == http.StatusBadRequest &&
+		strings.Contains(apiErr.Description, "message is not modified")
+}
+
+// isParseError reports whether Bot API refuses to send message since it could
+// not parse entities in text or caption.
+func isParseError(err error) bool {
+	var apiErr *APIError
+
+	return errors.As(err, &apiErr) &&
+		apiErr.Code == http.StatusBadRequest &&
+		strings.Contains(apiErr.Description, "can't parse entities")
+}
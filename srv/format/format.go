@@ -0,0 +1,393 @@
+// Package format converts CommonMark to text with entities of Telegram Bot
+// API. Entities do not require escaping, so text is displayed exactly as it
+// is written. Constructs which Telegram does not support (e.g. headers or
+// tables) degrade into monospace text.
+package format
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// MessageEntity is a special entity in text of message (e.g. bold text or
+// link). Offset and length are measured in UTF-16 code units.
+type MessageEntity struct {
+	Type     string `json:"type"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+	Url      string `json:"url,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+var markdown = goldmark.New(goldmark.WithExtensions(
+	extension.Table,
+	extension.Strikethrough,
+))
+
+// CommonMark converts CommonMark document to text and its entities.
+func CommonMark(source string) (string, []MessageEntity) {
+	src := []byte(source)
+	doc := markdown.Parser().Parse(text.NewReader(src))
+
+	w := &writer{source: src}
+	w.blocks(doc, "\n\n")
+
+	return w.result()
+}
+
+// writer accumulates text and entities. Length of text is kept in UTF-16
+// code units since Bot API measures offsets of entities in them.
+type writer struct {
+	source   []byte
+	text     strings.Builder
+	length   int
+	entities []MessageEntity
+
+	// indent is prepended to every line (e.g. to items of nested list).
+	indent string
+	bol    bool
+
+	// depth is number of entities which enclose current position. Code
+	// could not be a part of other entities except blockquote.
+	depth int
+}
+
+func (w *writer) write(s string) {
+	for _, r := range s {
+		if r != '\n' {
+			w.begin()
+		} else {
+			w.bol = true
+		}
+
+		w.text.WriteRune(r)
+		w.length += RuneLength(r)
+	}
+}
+
+// begin writes pending indentation and returns current offset.
+func (w *writer) begin() int {
+	if w.bol && len(w.indent) != 0 {
+		w.bol = false
+		w.write(w.indent)
+	}
+
+	w.bol = false
+	return w.length
+}
+
+// entity wraps text which fn writes into entity.
+func (w *writer) entity(entity MessageEntity, fn func()) {
+	if (entity.Type == "code" || entity.Type == "pre") && w.depth != 0 {
+		fn()
+		return
+	}
+
+	// blockquote could contain code
+	depth := w.depth
+
+	if entity.Type != "blockquote" {
+		w.depth += 1
+	}
+
+	entity.Offset = w.begin()
+	fn()
+	w.depth = depth
+
+	if entity.Length = w.length - entity.Offset; entity.Length != 0 {
+		w.entities = append(w.entities, entity)
+	}
+}
+
+// result returns text without trailing whitespaces and entities which are
+// sorted by offset.
+func (w *writer) result() (string, []MessageEntity) {
+	text := strings.TrimRight(w.text.String(), " \n")
+	length := w.length - TextLength(w.text.String()[len(text):])
+	entities := []MessageEntity{}
+
+	for _, entity := range w.entities {
+		if end := entity.Offset + entity.Length; end > length {
+			entity.Length -= end - length
+		}
+
+		if entity.Length > 0 {
+			entities = append(entities, entity)
+		}
+	}
+
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Offset < entities[j].Offset
+	})
+
+	return text, entities
+}
+
+// plain renders inline content of node without entities.
+func (w *writer) plain(node ast.Node) string {
+	sub := &writer{source: w.source, depth: 1}
+	sub.inlines(node)
+	return sub.text.String()
+}
+
+// blocks renders children of node separated by sep.
+func (w *writer) blocks(node ast.Node, sep string) {
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		if child != node.FirstChild() {
+			w.write(sep)
+		}
+
+		w.block(child)
+	}
+}
+
+func (w *writer) block(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		w.inlines(n)
+	case *ast.Heading:
+		w.entity(MessageEntity{Type: "code"}, func() {
+			w.write(w.plain(n))
+		})
+	case *ast.FencedCodeBlock:
+		language := string(n.Language(w.source))
+		w.entity(MessageEntity{Type: "pre", Language: language}, func() {
+			w.lines(n)
+		})
+	case *ast.CodeBlock:
+		w.entity(MessageEntity{Type: "pre"}, func() {
+			w.lines(n)
+		})
+	case *ast.HTMLBlock:
+		w.lines(n)
+	case *ast.Blockquote:
+		w.entity(MessageEntity{Type: "blockquote"}, func() {
+			w.blocks(n, "\n\n")
+		})
+	case *ast.List:
+		w.list(n)
+	case *ast.ThematicBreak:
+		w.write("———")
+	case *east.Table:
+		w.entity(MessageEntity{Type: "pre"}, func() {
+			w.table(n)
+		})
+	default:
+		w.blocks(n, "\n\n")
+	}
+}
+
+// lines renders raw lines of code block without trailing line break.
+func (w *writer) lines(node ast.Node) {
+	lines := []string{}
+
+	for i := 0; i != node.Lines().Len(); i++ {
+		line := node.Lines().At(i)
+		lines = append(lines, string(line.Value(w.source)))
+	}
+
+	w.write(strings.TrimRight(strings.Join(lines, ""), "\n"))
+}
+
+// list renders items with bullets or numbers. Items of nested lists are
+// indented.
+func (w *writer) list(list *ast.List) {
+	sep := "\n"
+
+	if !list.IsTight {
+		sep = "\n\n"
+	}
+
+	number := list.Start
+	indent := w.indent
+
+	for item := list.FirstChild(); item != nil; item = item.NextSibling() {
+		if item != list.FirstChild() {
+			w.write(sep)
+		}
+
+		marker := "• "
+
+		if list.IsOrdered() {
+			marker = strconv.Itoa(number) + ". "
+			number += 1
+		}
+
+		w.write(marker)
+		w.indent = indent + strings.Repeat(" ", utf8.RuneCountInString(marker))
+		w.blocks(item, sep)
+		w.indent = indent
+	}
+}
+
+// table renders table as text with aligned columns.
+func (w *writer) table(table *east.Table) {
+	rows := [][]string{}
+	widths := []int{}
+
+	for row := table.FirstChild(); row != nil; row = row.NextSibling() {
+		cells := []string{}
+
+		for cell := row.FirstChild(); cell != nil; cell = cell.NextSibling() {
+			value := w.plain(cell)
+
+			if len(widths) == len(cells) {
+				widths = append(widths, 0)
+			}
+
+			if width := utf8.RuneCountInString(value); width > widths[len(cells)] {
+				widths[len(cells)] = width
+			}
+
+			cells = append(cells, value)
+		}
+
+		rows = append(rows, cells)
+	}
+
+	for i, cells := range rows {
+		if i != 0 {
+			w.write("\n")
+		}
+
+		line := []string{}
+
+		for j, cell := range cells {
+			padding := widths[j] - utf8.RuneCountInString(cell)
+
+			if j < len(table.Alignments) && table.Alignments[j] == east.AlignRight {
+				line = append(line, strings.Repeat(" ", padding)+cell)
+			} else {
+				line = append(line, cell+strings.Repeat(" ", padding))
+			}
+		}
+
+		w.write(strings.TrimRight(strings.Join(line, " | "), " "))
+
+		// underline header
+		if _, ok := table.FirstChild().(*east.TableHeader); ok && i == 0 {
+			line = line[:0]
+
+			for _, width := range widths {
+				line = append(line, strings.Repeat("-", width))
+			}
+
+			w.write("\n" + strings.Join(line, "-+-"))
+		}
+	}
+}
+
+// inlines renders inline children of node.
+func (w *writer) inlines(node ast.Node) {
+	for child := node.FirstChild(); child != nil; child = child.NextSibling() {
+		w.inline(child)
+	}
+}
+
+func (w *writer) inline(node ast.Node) {
+	switch n := node.(type) {
+	case *ast.Text:
+		value := n.Segment.Value(w.source)
+
+		// resolve backslash escapes and character references
+		if !n.IsRaw() {
+			value = util.UnescapePunctuations(value)
+			value = util.ResolveNumericReferences(value)
+			value = util.ResolveEntityNames(value)
+		}
+
+		w.write(string(value))
+
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			w.write("\n")
+		}
+	case *ast.String:
+		w.write(string(n.Value))
+	case *ast.CodeSpan:
+		w.entity(MessageEntity{Type: "code"}, func() {
+			w.inlines(n)
+		})
+	case *ast.Emphasis:
+		entity := MessageEntity{Type: "italic"}
+
+		if n.Level == 2 {
+			entity.Type = "bold"
+		}
+
+		w.entity(entity, func() {
+			w.inlines(n)
+		})
+	case *east.Strikethrough:
+		w.entity(MessageEntity{Type: "strikethrough"}, func() {
+			w.inlines(n)
+		})
+	case *ast.Link:
+		w.link(n, string(n.Destination))
+	case *ast.Image:
+		w.link(n, string(n.Destination))
+	case *ast.AutoLink:
+		w.write(string(n.Label(w.source)))
+	case *ast.RawHTML:
+		for i := 0; i != n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			w.write(string(segment.Value(w.source)))
+		}
+	default:
+		w.inlines(n)
+	}
+}
+
+// link writes link with the URL. Bot API accepts only absolute URLs in
+// entities, so relative links and anchors are written as plain text which is
+// followed by the URL.
+func (w *writer) link(n ast.Node, url string) {
+	if isAbsoluteURL(url) {
+		w.entity(MessageEntity{Type: "text_link", Url: url}, func() {
+			w.inlines(n)
+		})
+		return
+	}
+
+	w.inlines(n)
+
+	if len(url) != 0 {
+		w.write(" (" + url + ")")
+	}
+}
+
+// isAbsoluteURL reports whether URL could be used in text_link entity.
+func isAbsoluteURL(url string) bool {
+	url = strings.ToLower(url)
+	return strings.HasPrefix(url, "http://") ||
+		strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "tg://")
+}
+
+// TextLength returns length of text in UTF-16 code units as Bot API counts
+// it.
+func TextLength(text string) int {
+	length := 0
+
+	for _, r := range text {
+		length += RuneLength(r)
+	}
+
+	return length
+}
+
+// RuneLength returns length of rune in UTF-16 code units.
+func RuneLength(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+
+	return 1
+}
@@ -0,0 +1,74 @@
+package format
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommonMark(t *testing.T) {
+	source := "# Report\n\n" +
+		"Loss is **0.41** and `lr=1\\_3`, see [logs](https://example.com).\n\n" +
+		"```python\nprint(loss)\n```\n\n" +
+		"- model\\_v2\n- 😀 _done_\n"
+
+	text, entities := CommonMark(source)
+
+	expected := "Report\n\n" +
+		"Loss is 0.41 and lr=1\\_3, see logs.\n\n" +
+		"print(loss)\n\n" +
+		"• model_v2\n• 😀 done"
+
+	if text != expected {
+		t.Fatalf("wrong text: %q", text)
+	}
+
+	expectedEntities := []MessageEntity{
+		{Type: "code", Offset: 0, Length: 6},
+		{Type: "bold", Offset: 16, Length: 4},
+		{Type: "code", Offset: 25, Length: 7},
+		{Type: "text_link", Offset: 38, Length: 4, Url: "https://example.com"},
+		{Type: "pre", Offset: 45, Length: 11, Language: "python"},
+		{Type: "italic", Offset: 74, Length: 4},
+	}
+
+	if !reflect.DeepEqual(entities, expectedEntities) {
+		t.Errorf("wrong entities: %+v", entities)
+	}
+}
+
+func TestCommonMarkTable(t *testing.T) {
+	source := "| model | loss |\n|-------|-----:|\n| bert | 0.41 |\n| gpt2 | 1.2 |\n"
+
+	text, entities := CommonMark(source)
+
+	expected := "model | loss\n" +
+		"------+-----\n" +
+		"bert  | 0.41\n" +
+		"gpt2  |  1.2"
+
+	if text != expected {
+		t.Fatalf("wrong text: %q", text)
+	}
+
+	if len(entities) != 1 || entities[0].Type != "pre" ||
+		entities[0].Length != len(expected) {
+		t.Errorf("wrong entities: %+v", entities)
+	}
+}
+
+func TestCommonMarkRelativeLink(t *testing.T) {
+	text, entities := CommonMark("See [results](results.csv), [x](#sec) " +
+		"and [chat](tg://resolve?domain=telepyth_bot).")
+
+	if text != "See results (results.csv), x (#sec) and chat." {
+		t.Fatalf("wrong text: %q", text)
+	}
+
+	expected := []MessageEntity{
+		{Type: "text_link", Offset: 40, Length: 4, Url: "tg://resolve?domain=telepyth_bot"},
+	}
+
+	if !reflect.DeepEqual(entities, expected) {
+		t.Errorf("wrong entities: %+v", entities)
+	}
+}
@@ -0,0 +1,177 @@
+package srv
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxLockoutClients is number of tracked addresses after which addresses
+// without recent failures are forgotten.
+const maxLockoutClients = 4096
+
+// Lockout counts failed authentications per client address. Once address
+// fails Threshold times, it is locked out and all its requests are rejected
+// until lockout is over. Every next lockout of the same address is twice as
+// long as the previous one. Successful requests do not reset failures, so a
+// valid token could not be used to keep on guessing.
+type Lockout struct {
+	// Threshold is number of failures which locks address out.
+	Threshold int
+
+	// Delay is duration of the first lockout and MaxDelay is the longest
+	// one.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// Window is how long failures of address are remembered since the last
+	// one.
+	Window time.Duration
+
+	mu       sync.Mutex
+	clients  map[string]*lockoutState
+	failures uint64
+	lockouts uint64
+	rejected uint64
+}
+
+type lockoutState struct {
+	failures    int
+	lockouts    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+func NewLockout() *Lockout {
+	return &Lockout{
+		Threshold: 10,
+		Delay:     time.Minute,
+		MaxDelay:  time.Hour,
+		Window:    24 * time.Hour,
+	}
+}
+
+// Locked returns how long address stays locked out at the given moment. It
+// is zero if address is not locked out.
+func (l *Lockout) Locked(addr string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if state, ok := l.clients[addr]; !ok || !now.Before(state.lockedUntil) {
+		return 0
+	} else {
+		l.rejected += 1
+		return state.lockedUntil.Sub(now)
+	}
+}
+
+// Fail counts failed authentication of address at the given moment. It
+// returns duration of lockout if address is locked out right now.
+func (l *Lockout) Fail(addr string, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.clients == nil {
+		l.clients = map[string]*lockoutState{}
+	} else if len(l.clients) >= maxLockoutClients {
+		l.prune(now)
+	}
+
+	state, ok := l.clients[addr]
+
+	// address starts from scratch if it behaves for long enough
+	if !ok || now.Sub(state.lastFailure) > l.Window {
+		state = &lockoutState{}
+		l.clients[addr] = state
+	}
+
+	state.failures += 1
+	state.lastFailure = now
+	l.failures += 1
+
+	if state.failures < l.Threshold {
+		return 0
+	}
+
+	delay := l.Delay
+
+	for i := 0; i != state.lockouts && delay < l.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+
+	state.failures = 0
+	state.lockouts += 1
+	state.lockedUntil = now.Add(delay)
+	l.lockouts += 1
+	return delay
+}
+
+// Clear forgets failures of address and lifts its lockout. It reports
+// whether address is known.
+func (l *Lockout) Clear(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, ok := l.clients[addr]
+	delete(l.clients, addr)
+	return ok
+}
+
+// prune forgets addresses which are neither locked out nor failed recently.
+func (l *Lockout) prune(now time.Time) {
+	for addr, state := range l.clients {
+		if !now.Before(state.lockedUntil) && now.Sub(state.lastFailure) > l.Window {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// LockoutStats are counters of failed authentications and addresses which
+// are locked out.
+type LockoutStats struct {
+	Failures uint64         `json:"failures"`
+	Lockouts uint64         `json:"lockouts"`
+	Rejected uint64         `json:"rejected"`
+	Locked   []LockedClient `json:"locked"`
+}
+
+// LockedClient is an address which is locked out.
+type LockedClient struct {
+	Addr        string    `json:"addr"`
+	Lockouts    int       `json:"lockouts"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+// Stats returns counters since start of server and addresses which are
+// locked out at the given moment.
+func (l *Lockout) Stats(now time.Time) *LockoutStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := &LockoutStats{
+		Failures: l.failures,
+		Lockouts: l.lockouts,
+		Rejected: l.rejected,
+		Locked:   []LockedClient{},
+	}
+
+	for addr, state := range l.clients {
+		if now.Before(state.lockedUntil) {
+			stats.Locked = append(stats.Locked, LockedClient{
+				Addr:        addr,
+				Lockouts:    state.lockouts,
+				LockedUntil: state.lockedUntil,
+			})
+		}
+	}
+
+	sort.Slice(stats.Locked, func(i, j int) bool {
+		return stats.Locked[i].Addr < stats.Locked[j].Addr
+	})
+
+	return stats
+}
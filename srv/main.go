@@ -1,40 +1,114 @@
 package srv
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/daskol/telepyth/srv/format"
 )
 
+// acceptTimeout is how long notify request waits for the first attempt to
+// deliver notification.
+const acceptTimeout = 10 * time.Second
+
+// maxWait is the longest time request could wait for delivery.
+const maxWait = 2 * time.Minute
+
+// maxIdempotencyKey is the longest idempotency key.
+const maxIdempotencyKey = 255
+
+// shutdownTimeout is how long server waits for in-flight requests on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
 const helpMessage = `@telepyth\_bot is Telegram notifications in Python.
 
 *Avaliable commands*:
 /start begin interaction and issue new token.
 /revoke revoke token issued before.
-/last send currently valid token or nothing.
+/new laptop issue new token with label.
+/tokens list labels of valid tokens.
+/revoke laptop revoke token with label.
+/rotate laptop 24h replace token with label, old one works for a while.
+/last show label of currently valid token or nothing.
+/long split or /long document choose how to deliver long messages.
+/digest 30, /digest 09:00 or /digest off collect notifications into summary.
+/quiet 23:00-08:00 Europe/Moscow hold or /quiet off set quiet hours.
 /help show help message and credentials.
 
 See source code and more examples on [github page](https://github.com/daskol/telepyth).`
 
 type TelePyth struct {
-	Api     *TelegramBotApi
-	Storage *Storage
+	Api        *TelegramBotApi
+	Storage    *Storage
+	Dispatcher *Dispatcher
+	Outbox     *Outbox
+	Scheduler  *Scheduler
 
 	Polling bool
 	Timeout int
 
+	// WebhookURL is a public URL which Bot API delivers updates to if
+	// polling is disabled. WebhookCert is a path to self-signed certificate
+	// of the URL. WebhookSecret is checked in every webhook request.
+	WebhookURL    string
+	WebhookCert   string
+	WebhookSecret string
+
 	MetricsLog string
+
+	// TrustedProxies are CIDR blocks of reverse proxies which address of
+	// client in `X-Forwarded-For` header is taken from.
+	TrustedProxies []string
+
+	// RotationGrace is how long rotated token stays valid unless user asks
+	// for another period. It is a day if it is zero.
+	RotationGrace time.Duration
+
+	// Lockout limits failed authentications per client address. They are
+	// not limited if it is nil.
+	Lockout *Lockout
+
+	// AdminToken grants access to administrative endpoints. The endpoints
+	// are disabled if it is empty.
+	AdminToken string
+
+	updates     chan Update
+	seenMu      sync.Mutex
+	seenUpdates map[int]bool
+	seenOrder   []int
 }
 
-func (t *TelePyth) HandleTelegramUpdate(update *Update) {
+func (t *TelePyth) HandleTelegramUpdate(ctx context.Context, update *Update) {
 	log.Println("update from", update.Message.From.Id)
 
-	switch update.Message.Text {
+	// command could be followed by arguments and by bot username
+	args := strings.Fields(update.Message.Text)
+	command := ""
+
+	if len(args) != 0 {
+		command = strings.SplitN(args[0], "@", 2)[0]
+		args = args[1:]
+	}
+
+	switch command {
 	case "/start":
 		log.Println(update.Message.From.Id, "send /start")
 		EnqueueLogRecord(update.Message.From.Id, "/start")
-		token, err := t.Storage.InsertUser(&update.Message.From)
+		grace, _ := t.rotationGrace("")
+		token, err := t.Storage.InsertUser(ctx, &update.Message.From, time.Now().Add(grace))
 
 		if err != nil {
 			//  TODO: log error and ask try again
@@ -42,11 +116,11 @@ func (t *TelePyth) HandleTelegramUpdate(update *Update) {
 			return
 		}
 
-		err = (&SendMessage{
+		_, err = t.Dispatcher.Send(ctx, &SendMessage{
 			ChatId:    update.Message.From.Id,
 			Text:      "Your access token is `" + token + "`.",
 			ParseMode: "Markdown",
-		}).To(t.Api)
+		}, PriorityInteractive)
 
 		if err != nil {
 			log.Println("error: ", err)
@@ -54,63 +128,95 @@ func (t *TelePyth) HandleTelegramUpdate(update *Update) {
 	case "/last":
 		log.Println(update.Message.From.Id, "send /last")
 		EnqueueLogRecord(update.Message.From.Id, "/last")
-		token, err := t.Storage.SelectTokenBy(&update.Message.From)
+		hash, err := t.Storage.SelectTokenBy(ctx, &update.Message.From)
 
 		if err != nil {
 			log.Println(err)
 			return
 		}
 
-		if revoked, err := t.Storage.IsTokenRevokedBy(token); err != nil {
+		// token is not stored, so it could be only reissued
+		if ut, err := t.Storage.SelectHashedToken(ctx, hash); err != nil {
 			log.Println("error: ", err)
-		} else if revoked {
-			err = (&SendMessage{
+		} else if ut.IsTokenRevoked {
+			_, err = t.Dispatcher.Send(ctx, &SendMessage{
 				ChatId: update.Message.From.Id,
 				Text: "You do not have any valid token. " +
 					"Send /start to issue new one.",
 				ParseMode: "Markdown",
-			}).To(t.Api)
+			}, PriorityInteractive)
 
 			if err != nil {
 				log.Println("error: ", err)
 			}
 		} else {
-			err = (&SendMessage{
-				ChatId:    update.Message.From.Id,
-				Text:      "Your last valid token is `" + token + "`.",
+			_, err = t.Dispatcher.Send(ctx, &SendMessage{
+				ChatId: update.Message.From.Id,
+				Text: "Your last valid token is `" + ut.Hint + "` labelled `" +
+					ut.Label + "`. Tokens are not kept, so send /rotate " +
+					ut.Label + " to get new one.",
 				ParseMode: "Markdown",
-			}).To(t.Api)
+			}, PriorityInteractive)
 
 			if err != nil {
 				log.Println("error: ", err)
 			}
 		}
+	case "/new":
+		log.Println(update.Message.From.Id, "send /new")
+		EnqueueLogRecord(update.Message.From.Id, "/new")
+		t.HandleNewCommand(ctx, &update.Message.From, args)
+	case "/rotate":
+		log.Println(update.Message.From.Id, "send /rotate")
+		EnqueueLogRecord(update.Message.From.Id, "/rotate")
+		t.HandleRotateCommand(ctx, &update.Message.From, args)
+	case "/tokens":
+		log.Println(update.Message.From.Id, "send /tokens")
+		EnqueueLogRecord(update.Message.From.Id, "/tokens")
+		t.HandleTokensCommand(ctx, &update.Message.From)
 	case "/revoke":
 		log.Println(update.Message.From.Id, "send /revoke")
 		EnqueueLogRecord(update.Message.From.Id, "/revoke")
 
-		if err := t.Storage.RevokeTokenBy(&update.Message.From); err != nil {
+		if len(args) != 0 {
+			t.HandleRevokeCommand(ctx, &update.Message.From, args[0])
+			return
+		}
+
+		if err := t.Storage.RevokeTokenBy(ctx, &update.Message.From); err != nil {
 			log.Println("error:", err)
 			return
 		}
 
-		err := (&SendMessage{
+		_, err := t.Dispatcher.Send(ctx, &SendMessage{
 			ChatId: update.Message.From.Id,
 			Text: "Token is already revoked. " +
 				"Send /start to obtain new token.",
-		}).To(t.Api)
+		}, PriorityInteractive)
 
 		if err != nil {
 			log.Println("error: ", err)
 		}
+	case "/long":
+		log.Println(update.Message.From.Id, "send /long")
+		EnqueueLogRecord(update.Message.From.Id, "/long")
+		t.HandleLongCommand(ctx, &update.Message.From, args)
+	case "/digest":
+		log.Println(update.Message.From.Id, "send /digest")
+		EnqueueLogRecord(update.Message.From.Id, "/digest")
+		t.HandleDigestCommand(ctx, &update.Message.From, args)
+	case "/quiet":
+		log.Println(update.Message.From.Id, "send /quiet")
+		EnqueueLogRecord(update.Message.From.Id, "/quiet")
+		t.HandleQuietCommand(ctx, &update.Message.From, args)
 	case "/help":
 		log.Println(update.Message.From.Id, "send /help")
 		EnqueueLogRecord(update.Message.From.Id, "/help")
-		err := (&SendMessage{
+		_, err := t.Dispatcher.Send(ctx, &SendMessage{
 			ChatId:    update.Message.From.Id,
 			Text:      helpMessage,
 			ParseMode: "Markdown",
-		}).To(t.Api)
+		}, PriorityInteractive)
 
 		if err != nil {
 			log.Println("error: ", err)
@@ -118,10 +224,10 @@ func (t *TelePyth) HandleTelegramUpdate(update *Update) {
 	default:
 		log.Println(update.Message.From.Id, "send unknown command")
 		EnqueueLogRecord(update.Message.From.Id, "<unknown>")
-		err := (&SendMessage{
+		_, err := t.Dispatcher.Send(ctx, &SendMessage{
 			ChatId: update.Message.From.Id,
 			Text:   "Unknown command. Try /help to see usage details.",
-		}).To(t.Api)
+		}, PriorityInteractive)
 
 		if err != nil {
 			log.Println("error: ", err)
@@ -129,35 +235,370 @@ func (t *TelePyth) HandleTelegramUpdate(update *Update) {
 	}
 }
 
-func (t *TelePyth) FindUser(req *http.Request) (*User, int) {
-	// split string to extract token
-	token := strings.TrimPrefix(req.RequestURI, "/api/notify/")
+// maxLabel is the longest label of token.
+const maxLabel = 32
 
-	if len(token) == 0 {
-		return nil, http.StatusBadRequest
+// isLabel reports whether label of token consists of letters, digits,
+// hyphens, underscores and dots.
+func isLabel(label string) bool {
+	if len(label) == 0 || len(label) > maxLabel {
+		return false
+	}
+
+	for _, r := range label {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+			!strings.ContainsRune("-_.", r) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HandleNewCommand issues new token with label, so user could have separate
+// tokens for different machines and revoke them independently. Label could
+// be followed by options of token policy.
+func (t *TelePyth) HandleNewCommand(ctx context.Context, user *User, args []string) {
+	msg := &SendMessage{ChatId: user.Id}
+	policy, ok := TokenPolicy{}, len(args) != 0
+
+	if ok {
+		policy, ok = parsePolicy(args[1:], time.Now())
+	}
+
+	if !ok || !isLabel(args[0]) {
+		msg.Text = "Usage: /new <label> [kinds=text,photo,document] " +
+			"[expires=7d] [uses=1] [from=10.0.0.0/8], e.g. /new laptop."
+	} else if token, err := t.Storage.InsertToken(ctx, user, args[0], policy); err == ErrLabelTaken {
+		msg.Text = "Token " + args[0] + " already exists. " +
+			"Revoke it with /revoke " + args[0] + " first."
+	} else if err != nil {
+		log.Println("error:", err)
+		return
+	} else {
+		msg.Text = "Your access token `" + args[0] + "` is `" + token + "`."
+		msg.ParseMode = "Markdown"
+	}
+
+	if _, err := t.Dispatcher.Send(ctx, msg, PriorityInteractive); err != nil {
+		log.Println("error: ", err)
+	}
+}
+
+// HandleTokensCommand lists labels of valid tokens of user. Tokens are
+// redacted.
+func (t *TelePyth) HandleTokensCommand(ctx context.Context, user *User) {
+	tokens, err := t.Storage.SelectTokens(ctx, user)
+
+	if err != nil {
+		log.Println("error:", err)
+		return
+	}
+
+	text := "You do not have any valid token. Send /start to issue new one."
+
+	if len(tokens) != 0 {
+		lines := []string{"Your tokens:"}
+
+		for _, token := range tokens {
+			line := token.Label + " " + token.Hint
+
+			if token.Legacy {
+				line += " legacy, /rotate it"
+			}
+
+			if !token.CreatedAt.IsZero() {
+				line += " issued " + token.CreatedAt.UTC().Format("2006-01-02")
+			}
+
+			if policy := token.Policy.Describe(token.Uses); len(policy) != 0 {
+				line += " (" + policy + ")"
+			}
+
+			lines = append(lines, line)
+		}
+
+		text = strings.Join(lines, "\n")
+	}
+
+	_, err = t.Dispatcher.Send(ctx, &SendMessage{
+		ChatId: user.Id,
+		Text:   text,
+	}, PriorityInteractive)
+
+	if err != nil {
+		log.Println("error: ", err)
+	}
+}
+
+// HandleRevokeCommand revokes token with label. Other tokens of user stay
+// valid.
+func (t *TelePyth) HandleRevokeCommand(ctx context.Context, user *User, label string) {
+	text := "Token " + label + " is revoked."
+
+	if err := t.Storage.RevokeToken(ctx, user, label); err == ErrUnknownLabel {
+		text = "There is no valid token " + label + ". See /tokens."
+	} else if err != nil {
+		log.Println("error:", err)
+		return
+	}
+
+	_, err := t.Dispatcher.Send(ctx, &SendMessage{
+		ChatId: user.Id,
+		Text:   text,
+	}, PriorityInteractive)
+
+	if err != nil {
+		log.Println("error: ", err)
+	}
+}
+
+// HandleLongCommand shows or changes how text which does not fit a single
+// message is delivered to user.
+func (t *TelePyth) HandleLongCommand(ctx context.Context, user *User, args []string) {
+	text := ""
+
+	if len(args) == 0 {
+		if prefs, err := t.Storage.SelectPreferences(ctx, user); err != nil {
+			log.Println("error:", err)
+			return
+		} else if prefs.LongMessage == LongMessageDocument {
+			text = "Long messages are sent as documents."
+		} else {
+			text = "Long messages are split into several messages."
+		}
+	} else if policy := strings.ToLower(args[0]); !IsLongMessagePolicy(policy) {
+		text = "Usage: /long split or /long document."
+	} else {
+		err := t.Storage.UpdatePreferences(ctx, user, func(p *Preferences) {
+			p.LongMessage = policy
+		})
+
+		if err != nil {
+			log.Println("error:", err)
+			return
+		}
+
+		text = "Long messages will be sent as " + policy + "."
+
+		if policy == LongMessageSplit {
+			text = "Long messages will be split into several messages."
+		}
+	}
+
+	_, err := t.Dispatcher.Send(ctx, &SendMessage{
+		ChatId: user.Id,
+		Text:   text,
+	}, PriorityInteractive)
+
+	if err != nil {
+		log.Println("error: ", err)
+	}
+}
+
+// HandleDigestCommand shows or changes how often non-urgent notifications
+// are sent to user as a single summary.
+func (t *TelePyth) HandleDigestCommand(ctx context.Context, user *User, args []string) {
+	text := ""
+	digest := &Preferences{}
+
+	if len(args) == 0 {
+		if prefs, err := t.Storage.SelectPreferences(ctx, user); err != nil {
+			log.Println("error:", err)
+			return
+		} else {
+			text = prefs.DescribeDigest()
+		}
+	} else if !parseDigest(args[0], digest) {
+		text = "Usage: /digest 30 (minutes), /digest 09:00 or /digest off."
+	} else {
+		err := t.Storage.UpdatePreferences(ctx, user, func(p *Preferences) {
+			p.DigestInterval = digest.DigestInterval
+			p.DigestDaily = digest.DigestDaily
+			p.DigestAt = digest.DigestAt
+		})
+
+		if err != nil {
+			log.Println("error:", err)
+			return
+		}
+
+		text = digest.DescribeDigest()
+	}
+
+	_, err := t.Dispatcher.Send(ctx, &SendMessage{
+		ChatId: user.Id,
+		Text:   text,
+	}, PriorityInteractive)
+
+	if err != nil {
+		log.Println("error: ", err)
+	}
+}
+
+// HandleQuietCommand shows or changes quiet hours and time zone of user.
+func (t *TelePyth) HandleQuietCommand(ctx context.Context, user *User, args []string) {
+	prefs, err := t.Storage.SelectPreferences(ctx, user)
+
+	if err != nil {
+		log.Println("error:", err)
+		return
+	}
+
+	text := ""
+
+	if len(args) == 0 {
+		text = prefs.DescribeQuiet()
+	} else if !parseQuiet(args, prefs) {
+		text = "Usage: /quiet 23:00-08:00 [time zone] [silent or hold] " +
+			"or /quiet off."
+	} else {
+		err := t.Storage.UpdatePreferences(ctx, user, func(p *Preferences) {
+			p.Quiet = prefs.Quiet
+			p.QuietFrom = prefs.QuietFrom
+			p.QuietTo = prefs.QuietTo
+			p.QuietHold = prefs.QuietHold
+			p.Timezone = prefs.Timezone
+		})
+
+		if err != nil {
+			log.Println("error:", err)
+			return
+		}
+
+		text = prefs.DescribeQuiet()
+	}
+
+	_, err = t.Dispatcher.Send(ctx, &SendMessage{
+		ChatId: user.Id,
+		Text:   text,
+	}, PriorityInteractive)
+
+	if err != nil {
+		log.Println("error: ", err)
 	}
+}
+
+// RequestToken extracts access token from request. Token is passed either in
+// `Authorization: Bearer <token>` header or in `X-Telepyth-Token` header. For
+// backward compatibility, it could be passed in path as well (e.g.
+// /api/notify/<token> or /api/edit/<token>/<id>).
+func RequestToken(req *http.Request) string {
+	if token, ok := headerToken(req); ok {
+		return token
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 4)
 
-	// is token valid
-	if revoked, err := t.Storage.IsTokenRevokedBy(token); err != nil {
-		return nil, http.StatusInternalServerError
-	} else if revoked {
-		return nil, http.StatusUnauthorized
+	if len(parts) < 3 {
+		return ""
 	}
 
-	// get user by token
-	user, err := t.Storage.SelectUserBy(token)
+	return parts[2]
+}
+
+// headerToken extracts access token from headers of request.
+func headerToken(req *http.Request) (string, bool) {
+	if auth := req.Header.Get("Authorization"); len(auth) > 7 &&
+		strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:]), true
+	} else if token := req.Header.Get("X-Telepyth-Token"); len(token) != 0 {
+		return token, true
+	}
+
+	return "", false
+}
+
+// requestReceiptId extracts identifier of receipt from path of edit request
+// (i.e. /api/edit/<id> or /api/edit/<token>/<id>).
+func requestReceiptId(req *http.Request) string {
+	suffix := strings.TrimPrefix(req.URL.Path, "/api/edit/")
+
+	if _, ok := headerToken(req); ok && !strings.Contains(suffix, "/") {
+		return suffix
+	} else if parts := strings.SplitN(suffix, "/", 2); len(parts) == 2 {
+		return parts[1]
+	}
+
+	return ""
+}
+
+func (t *TelePyth) FindUser(w http.ResponseWriter, req *http.Request) (*User, error) {
+	return t.findUser(w, req, RequestToken(req))
+}
+
+// findUser returns user whom token belongs to. Token is checked against its
+// policy: request with unknown, revoked, expired or used up token or from
+// address which is not allowed is unauthorized. Client could not tell these
+// cases apart, and address which fails too often is locked out. Rotated
+// token is valid until its grace period is over and response warns about
+// that.
+func (t *TelePyth) findUser(w http.ResponseWriter, req *http.Request, token string) (*User, error) {
+	addr := t.clientIP(req).String()
+
+	if t.Lockout == nil {
+		// authentication attempts are not limited
+	} else if wait := t.Lockout.Locked(addr, time.Now()); wait > 0 {
+		log.Println("address", addr, "is locked out")
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		return nil, errorStatus(http.StatusTooManyRequests)
+	}
+
+	ut, reason, err := t.authorize(req, token)
 
 	if err != nil {
-		return nil, http.StatusNotFound
+		log.Println("error:", err)
+		return nil, errorStatus(http.StatusInternalServerError)
+	} else if len(reason) != 0 {
+		log.Println("token", RedactToken(token), "from", addr, "is rejected:", reason)
+
+		if t.Lockout == nil {
+			// failure is not counted
+		} else if delay := t.Lockout.Fail(addr, time.Now()); delay > 0 {
+			log.Println("address", addr, "is locked out for", delay)
+		}
+
+		return nil, errorStatus(http.StatusUnauthorized)
+	}
+
+	if ut.IsRotated() {
+		log.Println("token", RedactToken(token), "is rotated but still used")
+		deprecateToken(w, ut)
+	} else if ut.Legacy {
+		w.Header().Add("Warning", `299 - "token is legacy, rotate it"`)
 	}
 
-	log.Println("token", token, "belongs to user", user.Id)
+	log.Println("token", RedactToken(token), "belongs to user", ut.Id)
 
-	return user, http.StatusOK
+	return &ut.User, nil
 }
 
-func (t *TelePyth) HandleWebhookRequest(w http.ResponseWriter, req *http.Request) {
-	log.Println("HandleWebhookRequest(): not implemented!")
+// authorize checks token of request. It returns reason why token is rejected
+// if token is not valid.
+func (t *TelePyth) authorize(req *http.Request, token string) (*UserToken, string, error) {
+	if len(token) == 0 {
+		return nil, "token is missing", nil
+	}
+
+	ut, err := t.Storage.SelectUserToken(req.Context(), token)
+
+	switch {
+	case err == ErrUnknownToken:
+		return nil, "unknown token", nil
+	case err != nil:
+		return nil, "", err
+	case ut.IsTokenRevoked:
+		return nil, "token is revoked", nil
+	case ut.Policy.IsExpired(time.Now()):
+		return nil, "token is expired", nil
+	case ut.IsRotated() && !time.Now().Before(ut.GraceUntil):
+		return nil, "token is rotated", nil
+	case !ut.Policy.AllowsAddr(t.clientIP(req)):
+		return nil, "address is not allowed", nil
+	}
+
+	// uses of token are counted once notification is accepted
+	return ut, "", nil
 }
 
 func (t *TelePyth) HandleNotifyRequest(w http.ResponseWriter, req *http.Request) {
@@ -167,33 +608,52 @@ func (t *TelePyth) HandleNotifyRequest(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	status := http.StatusOK
+	// accept legacy plain/text along with text/plain
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
 
-	// check that content type is plain/text
-	if contentType, ok := req.Header["Content-Type"]; !ok {
-		status = http.StatusBadRequest
-	} else if contentType[0] == "plain/text" ||
-		strings.HasPrefix(contentType[0], "plain/text; ") {
-		status = t.HandlePlainTextNotifyRequest(w, req)
-	} else if contentType[0] == "multipart/form-data" ||
-		strings.HasPrefix(contentType[0], "multipart/form-data; ") {
-		status = t.HandleMultipartNotifyRequest(w, req)
-	} else {
-		for k, v := range contentType {
-			log.Println(k, v)
+	if err != nil {
+		writeError(w, errorStatus(http.StatusBadRequest))
+		return
+	}
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/batch"):
+		if mediaType != "application/json" {
+			err = errorStatus(http.StatusBadRequest)
+		} else {
+			err = t.HandleBatchNotifyRequest(w, req)
+		}
+
+		if err != nil {
+			writeJSONError(w, err)
 		}
 
-		status = http.StatusBadRequest
+		return
+	case mediaType == "text/plain", mediaType == "plain/text":
+		err = t.HandlePlainTextNotifyRequest(w, req)
+	case mediaType == "multipart/form-data":
+		err = t.HandleMultipartNotifyRequest(w, req)
+	case mediaType == "application/json":
+		if err := t.HandleJSONNotifyRequest(w, req); err != nil {
+			writeJSONError(w, err)
+		}
+
+		return
+	default:
+		log.Println("unsupported content type", mediaType)
+		err = errorStatus(http.StatusBadRequest)
 	}
 
-	w.WriteHeader(status)
+	if err != nil {
+		writeError(w, err)
+	}
 }
 
-func (t *TelePyth) HandlePlainTextNotifyRequest(w http.ResponseWriter, req *http.Request) int {
-	user, status := t.FindUser(req)
+func (t *TelePyth) HandlePlainTextNotifyRequest(w http.ResponseWriter, req *http.Request) error {
+	user, err := t.FindUser(w, req)
 
-	if status >= 400 {
-		return status
+	if err != nil {
+		return err
 	}
 
 	// count send_message event
@@ -203,36 +663,181 @@ func (t *TelePyth) HandlePlainTextNotifyRequest(w http.ResponseWriter, req *http
 	bytes, err := ioutil.ReadAll(req.Body)
 
 	if err != nil {
-		return http.StatusInternalServerError
+		return errorStatus(http.StatusInternalServerError)
 	}
 
-	// send notification to user
-	err = (&SendMessage{
-		ChatId:    user.Id,
-		Text:      string(bytes),
-		ParseMode: "Markdown",
-	}).To(t.Api)
+	parseMode, err := RequestParseMode(req, "Markdown")
+
+	if err != nil {
+		return err
+	}
+
+	policy, err := t.LongMessagePolicy(req, user)
 
 	if err != nil {
-		return http.StatusServiceUnavailable
+		return err
 	}
 
-	return http.StatusOK
+	sendAt, err := RequestSendAt(req)
+
+	if err != nil {
+		return err
+	}
+
+	priority, err := RequestPriority(req)
+
+	if err != nil {
+		return err
+	}
+
+	// send notification to user
+	return t.push(w, req, &Notification{
+		Token:       t.Storage.HashToken(RequestToken(req)),
+		ChatId:      user.Id,
+		Text:        string(bytes),
+		ParseMode:   parseMode,
+		LongMessage: policy,
+		Priority:    priority,
+		SendAt:      sendAt,
+	})
 }
 
-func (t *TelePyth) HandleMultipartNotifyRequest(w http.ResponseWriter, req *http.Request) int {
-	user, status := t.FindUser(req)
+// parseModes maps parse modes which client could request to parse modes of
+// Bot API.
+var parseModes = map[string]string{
+	"markdown":   "Markdown",
+	"markdownv2": "MarkdownV2",
+	"html":       "HTML",
+	"commonmark": ParseModeCommonMark,
+	"none":       "",
+}
+
+// RequestParseMode chooses how text is formatted. Request chooses it with
+// `X-Telepyth-Parse-Mode` header or with `parse_mode` query parameter
+// (markdown, markdownv2, html, commonmark or none). Otherwise, parse mode is fallback.
+func RequestParseMode(req *http.Request, fallback string) (string, error) {
+	value := req.Header.Get("X-Telepyth-Parse-Mode")
 
-	if status >= 400 {
-		return status
+	if len(value) == 0 {
+		value = req.URL.Query().Get("parse_mode")
 	}
 
-	// count send_message event
-	EnqueueLogRecord(user.Id, "send_figure")
+	if len(value) == 0 {
+		return fallback, nil
+	} else if parseMode, ok := parseModes[strings.ToLower(value)]; ok {
+		return parseMode, nil
+	}
+
+	return "", &httpError{http.StatusBadRequest, "wrong parse mode"}
+}
+
+// LongMessagePolicy chooses how text which does not fit a single message is
+// delivered. Request chooses it with `X-Telepyth-Long-Message` header or with
+// `long` query parameter. Otherwise, preferences of user are applied.
+func (t *TelePyth) LongMessagePolicy(req *http.Request, user *User) (string, error) {
+	policy := req.Header.Get("X-Telepyth-Long-Message")
+
+	if len(policy) == 0 {
+		policy = req.URL.Query().Get("long")
+	}
+
+	if len(policy) != 0 {
+		if policy = strings.ToLower(policy); !IsLongMessagePolicy(policy) {
+			return "", &httpError{http.StatusBadRequest, "wrong long message policy"}
+		}
+
+		return policy, nil
+	}
+
+	if prefs, err := t.Storage.SelectPreferences(req.Context(), user); err != nil {
+		log.Println("error:", err)
+		return "", errorStatus(http.StatusInternalServerError)
+	} else if len(prefs.LongMessage) != 0 {
+		return prefs.LongMessage, nil
+	}
+
+	return LongMessageSplit, nil
+}
+
+// RequestPriority chooses priority of notification with `X-Telepyth-Priority`
+// header or with `priority` query parameter (low, normal or urgent). Urgent
+// notifications are sent immediately even within quiet hours or in digest
+// mode.
+func RequestPriority(req *http.Request) (string, error) {
+	priority := req.Header.Get("X-Telepyth-Priority")
+
+	if len(priority) == 0 {
+		priority = req.URL.Query().Get("priority")
+	}
+
+	if priority = strings.ToLower(priority); len(priority) != 0 && !IsPriority(priority) {
+		return "", &httpError{http.StatusBadRequest, "wrong priority"}
+	}
+
+	return priority, nil
+}
+
+// RequestSendAt chooses when notification is sent. Request chooses either
+// moment with `X-Telepyth-Send-At` header or with `send_at` query parameter
+// or delay with `X-Telepyth-Delay` header or with `delay` query parameter.
+// Zero moment means that notification is sent immediately.
+func RequestSendAt(req *http.Request) (time.Time, error) {
+	sendAt := req.Header.Get("X-Telepyth-Send-At")
+
+	if len(sendAt) == 0 {
+		sendAt = req.URL.Query().Get("send_at")
+	}
+
+	delay := req.Header.Get("X-Telepyth-Delay")
+
+	if len(delay) == 0 {
+		delay = req.URL.Query().Get("delay")
+	}
+
+	return parseSendAt(sendAt, delay)
+}
+
+// parseSendAt parses moment of sending either in RFC 3339 or as Unix time
+// and delay either in Go notation (e.g. `90m` or `6h`) or in seconds.
+func parseSendAt(sendAt, delay string) (time.Time, error) {
+	if len(sendAt) != 0 && len(delay) != 0 {
+		return time.Time{}, &httpError{http.StatusBadRequest, "either send_at or delay"}
+	}
+
+	if len(sendAt) != 0 {
+		if moment, err := time.Parse(time.RFC3339, sendAt); err == nil {
+			return moment, nil
+		} else if seconds, err := strconv.ParseInt(sendAt, 10, 64); err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+
+		return time.Time{}, &httpError{http.StatusBadRequest, "wrong send_at"}
+	}
+
+	if len(delay) != 0 {
+		if duration, ok := parseDuration(delay); ok && duration >= 0 {
+			return time.Now().Add(duration), nil
+		}
+
+		return time.Time{}, &httpError{http.StatusBadRequest, "wrong delay"}
+	}
+
+	return time.Time{}, nil
+}
+
+// HandleMultipartNotifyRequest sends figures as photos and arbitrary files
+// as documents. Original file names and content types of documents are kept.
+// Several files are sent as albums with caption on the first item.
+func (t *TelePyth) HandleMultipartNotifyRequest(w http.ResponseWriter, req *http.Request) error {
+	user, err := t.FindUser(w, req)
+
+	if err != nil {
+		return err
+	}
 
 	//  parse form
 	if err := req.ParseMultipartForm(10 * 1024 * 1024); err != nil {
-		return http.StatusBadRequest
+		return errorStatus(http.StatusBadRequest)
 	}
 
 	caption := ""
@@ -241,29 +846,369 @@ func (t *TelePyth) HandleMultipartNotifyRequest(w http.ResponseWriter, req *http
 		caption = captions[0]
 	}
 
-	figure, ok := req.MultipartForm.File["figure"]
+	figures := req.MultipartForm.File["figure"]
+	documents := req.MultipartForm.File["document"]
+
+	if len(figures) == 0 && len(documents) == 0 {
+		return errorStatus(http.StatusBadRequest)
+	}
+
+	// caption is not formatted unless client asks
+	parseMode, err := RequestParseMode(req, "")
+
+	if err != nil {
+		return err
+	}
+
+	sendAt, err := RequestSendAt(req)
+
+	if err != nil {
+		return err
+	}
+
+	priority, err := RequestPriority(req)
+
+	if err != nil {
+		return err
+	}
+
+	// count send_figure and send_document events
+	if len(figures) != 0 {
+		EnqueueLogRecord(user.Id, "send_figure")
+	}
+
+	if len(documents) != 0 {
+		EnqueueLogRecord(user.Id, "send_document")
+	}
+
+	attachments := []Attachment{}
+
+	for _, part := range []struct {
+		kind    string
+		headers []*multipart.FileHeader
+	}{{KindPhoto, figures}, {KindDocument, documents}} {
+		for _, header := range part.headers {
+			if attachment, err := readAttachment(part.kind, header); err != nil {
+				return errorStatus(http.StatusInternalServerError)
+			} else {
+				attachments = append(attachments, *attachment)
+			}
+		}
+	}
+
+	return t.push(w, req, &Notification{
+		Token:       t.Storage.HashToken(RequestToken(req)),
+		ChatId:      user.Id,
+		Caption:     caption,
+		ParseMode:   parseMode,
+		Attachments: attachments,
+		Priority:    priority,
+		SendAt:      sendAt,
+	})
+}
+
+// readAttachment reads file from multipart form.
+func readAttachment(kind string, header *multipart.FileHeader) (*Attachment, error) {
+	file, err := header.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attachment{
+		Kind:        kind,
+		FileName:    header.Filename,
+		ContentType: header.Header.Get("Content-Type"),
+		Data:        data,
+	}, nil
+}
+
+// push puts notification into outbox and waits for the first delivery
+// attempt or, if client asks, until notification is delivered. Notification
+// which is not delivered yet but which will be retried is reported as
+// accepted. Notification which is scheduled for later or which is held for
+// digest is not awaited. Response contains receipt unless notification is
+// finally rejected by Bot API, in which case the error is reported. Repeated
+// request with the same `Idempotency-Key` header gets receipt of the original
+// notification.
+func (t *TelePyth) push(w http.ResponseWriter, req *http.Request, n *Notification) error {
+	timeout, final, err := parseWait(req)
+
+	if err != nil {
+		return err
+	}
+
+	n.IdempotencyKey = req.Header.Get("Idempotency-Key")
+
+	if len(n.IdempotencyKey) > maxIdempotencyKey {
+		return &httpError{http.StatusBadRequest, "idempotency key is too long"}
+	}
+
+	ch, stop, err := t.accept(req.Context(), n)
+
+	var httpErr *httpError
+
+	if errors.Is(err, ErrRepeatedRequest) {
+		log.Println("repeated request of user", n.ChatId)
+		w.Header().Set("Idempotent-Replayed", "true")
+		return t.writeReceipt(w, req, n.ReceiptId)
+	} else if errors.As(err, &httpErr) {
+		return err
+	} else if err != nil {
+		log.Println("error:", err)
+		return errorStatus(http.StatusInternalServerError)
+	} else if ch == nil {
+		// scheduled or held notification is not awaited
+		return t.writeReceipt(w, req, n.ReceiptId)
+	}
+
+	attempt := t.Outbox.Await(req.Context(), n.Id, ch, stop, timeout, final)
+
+	if attempt != nil && attempt.Final && attempt.Err != nil {
+		return attempt.Err
+	}
+
+	return t.writeReceipt(w, req, n.ReceiptId)
+}
+
+// writeReceipt responds with receipt. Status of response depends on state of
+// notification.
+func (t *TelePyth) writeReceipt(w http.ResponseWriter, req *http.Request, id string) error {
+	receipt, err := t.Storage.SelectReceipt(req.Context(), id)
+
+	if err != nil {
+		log.Println("error:", err)
+		return errorStatus(http.StatusInternalServerError)
+	}
+
+	writeJSON(w, receiptStatus(receipt), receipt)
+	return nil
+}
+
+// receiptStatus returns HTTP status which corresponds to state of
+// notification.
+func receiptStatus(receipt *Receipt) int {
+	switch receipt.State {
+	case StateSent, StateCancelled:
+		return http.StatusOK
+	case StateFailed:
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusAccepted
+	}
+}
+
+// parseWait extracts from query how long request should wait for delivery
+// of notification. Duration is either in Go notation (e.g. `90s` or `2m`) or
+// in seconds. Empty value means the longest wait. If there is no `wait`
+// parameter then only the first delivery attempt is awaited.
+func parseWait(req *http.Request) (time.Duration, bool, error) {
+	values, ok := req.URL.Query()["wait"]
 
 	if !ok {
-		return http.StatusBadRequest
+		return acceptTimeout, false, nil
+	} else if len(values[0]) == 0 {
+		return maxWait, true, nil
+	}
+
+	wait, ok := parseDuration(values[0])
+
+	if !ok || wait < 0 {
+		return 0, false, &httpError{http.StatusBadRequest, "wrong wait"}
+	} else if wait > maxWait {
+		wait = maxWait
+	}
+
+	return wait, true, nil
+}
+
+// parseDuration parses duration either in Go notation or in seconds.
+func parseDuration(value string) (time.Duration, bool) {
+	if duration, err := time.ParseDuration(value); err == nil {
+		return duration, true
+	} else if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
 	}
 
-	file, err := figure[0].Open()
+	return 0, false
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("error:", err)
+	}
+}
+
+// HandleMessageRequest reports delivery status of notification by its
+// receipt. Query parameter `wait` makes request block until notification is
+// either delivered or buried.
+func (t *TelePyth) HandleMessageRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/api/messages/")
+	receipt, err := t.Storage.SelectReceipt(req.Context(), id)
+
+	if err != nil {
+		writeError(w, errorStatus(http.StatusNotFound))
+		return
+	}
+
+	timeout, final, err := parseWait(req)
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// scheduled or held notification is not awaited
+	if final && receipt.State == StateQueued {
+		ch, stop := t.Outbox.Watch(receipt.NotificationId)
+
+		// notification could be delivered before watching started
+		if r, err := t.Storage.SelectReceipt(req.Context(), id); err == nil && r.IsFinal() {
+			stop()
+		} else {
+			t.Outbox.Await(req.Context(), receipt.NotificationId, ch, stop, timeout, true)
+		}
+
+		if r, err := t.Storage.SelectReceipt(req.Context(), id); err == nil {
+			receipt = r
+		}
+	}
+
+	writeJSON(w, http.StatusOK, receipt)
+}
+
+// HandleEditRequest replaces text or caption of notification which was
+// delivered before. Notification is referred by its receipt and it could be
+// edited with the same token which sent it.
+//
+//	POST /api/edit/<token>/<receipt_id>
+func (t *TelePyth) HandleEditRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if err := t.HandlePlainTextEditRequest(w, req); err != nil {
+		writeError(w, err)
+	}
+}
+
+func (t *TelePyth) HandlePlainTextEditRequest(w http.ResponseWriter, req *http.Request) error {
+	user, err := t.FindUser(w, req)
+
+	if err != nil {
+		return err
+	}
+
+	id := requestReceiptId(req)
+
+	if len(id) == 0 {
+		return errorStatus(http.StatusNotFound)
+	}
+
+	receipt, err := t.Storage.SelectReceipt(req.Context(), id)
+
+	// receipt could be edited with replacement of token which sent it
+	if err != nil || !t.Storage.SameLineage(req.Context(), receipt.Token, t.Storage.HashToken(RequestToken(req))) {
+		return errorStatus(http.StatusNotFound)
+	} else if receipt.State != StateSent {
+		return &httpError{http.StatusConflict, "notification is not delivered"}
+	} else if receipt.Digest {
+		return &httpError{http.StatusConflict, "notification is delivered in digest"}
+	}
+
+	// count edit_message event
+	EnqueueLogRecord(user.Id, "edit_message")
+
+	// extract new text of message
+	bytes, err := ioutil.ReadAll(req.Body)
 
 	if err != nil {
-		return http.StatusInternalServerError
+		return errorStatus(http.StatusInternalServerError)
 	}
 
-	err = (&SendPhoto{
-		ChatId:  user.Id,
-		Photo:   file,
-		Caption: caption,
-	}).To(t.Api)
+	// caption is not formatted unless client asks
+	parseMode, err := RequestParseMode(req, "Markdown")
+
+	if receipt.Media {
+		parseMode, err = RequestParseMode(req, "")
+	}
 
 	if err != nil {
-		return http.StatusServiceUnavailable
+		return err
 	}
 
-	return http.StatusOK
+	edit := func(parseMode string) error {
+		var sender Sender
+		var entities []MessageEntity
+
+		text := string(bytes)
+
+		if parseMode == ParseModeCommonMark {
+			text, entities = format.CommonMark(text)
+			parseMode = ""
+		}
+
+		if receipt.Media {
+			sender = &EditMessageCaption{
+				ChatId:          receipt.ChatId,
+				MessageId:       receipt.MessageId,
+				Caption:         text,
+				ParseMode:       parseMode,
+				CaptionEntities: entities,
+			}
+		} else {
+			sender = &EditMessageText{
+				ChatId:    receipt.ChatId,
+				MessageId: receipt.MessageId,
+				Text:      text,
+				ParseMode: parseMode,
+				Entities:  entities,
+			}
+		}
+
+		_, err := t.Dispatcher.Send(req.Context(), sender, PriorityNotify)
+		return err
+	}
+
+	// edit without formatting if markup is malformed
+	fallback := false
+	err = edit(parseMode)
+
+	if isParseError(err) && len(parseMode) != 0 {
+		fallback = true
+		err = edit("")
+	}
+
+	// edit of message with the same content is not an error for client
+	if err != nil && !isNotModified(err) {
+		return err
+	}
+
+	// receipt is kept as long as message is edited
+	if receipt, err = t.Storage.EditReceipt(req.Context(), id, fallback); err != nil {
+		log.Println("error:", err)
+		return errorStatus(http.StatusInternalServerError)
+	}
+
+	writeJSON(w, http.StatusOK, receipt)
+	return nil
 }
 
 func (t *TelePyth) HandlePingRequest(w http.ResponseWriter, req *http.Request) {
@@ -281,19 +1226,27 @@ func (t *TelePyth) HandlePingRequest(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func (t *TelePyth) PollUpdates() {
+// PollUpdates receives updates with long polling and handles them one by one.
+// It returns when context is cancelled.
+func (t *TelePyth) PollUpdates(ctx context.Context) {
 	offset := 0
 
-	for {
-		updates, err := t.Api.GetUpdates(offset, 100, t.Timeout, nil)
+	for ctx.Err() == nil {
+		updates, err := t.Api.GetUpdates(ctx, offset, 100, t.Timeout, nil)
 
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			//  TODO: more logging
 			log.Println(err)
+
+			// do not flood Bot API while it is unavailable
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+			}
 		}
 
 		for _, update := range updates {
-			t.HandleTelegramUpdate(&update)
+			t.HandleTelegramUpdate(ctx, &update)
 
 			if update.UpdateId >= offset {
 				offset = update.UpdateId + 1
@@ -302,7 +1255,13 @@ func (t *TelePyth) PollUpdates() {
 	}
 }
 
-func (t *TelePyth) Serve() error {
+// Serve runs bot and HTTP server. It stops when context is cancelled and
+// returns after HTTP server is shut down.
+func (t *TelePyth) Serve(ctx context.Context) error {
+	if err := t.checkWebhook(); err != nil {
+		return err
+	}
+
 	// run logging of events
 	go func() {
 		if err := RunLogger(t.MetricsLog); err != nil {
@@ -310,24 +1269,90 @@ func (t *TelePyth) Serve() error {
 		}
 	}()
 
-	// run go-routing for long polling
+	// run dispatcher of outbound requests to Bot API
+	if t.Dispatcher == nil {
+		t.Dispatcher = NewDispatcher(t.Api)
+	}
+
+	go t.Dispatcher.Run(ctx)
+
+	// run delivery of notifications from persistent outbox
+	if t.Outbox == nil {
+		t.Outbox = NewOutbox(t.Storage, t.Dispatcher)
+	}
+
+	go t.Outbox.Run(ctx)
+
+	// clients behind reverse proxy share its address, so all of them are
+	// locked out at once
+	if t.Lockout != nil && len(t.TrustedProxies) == 0 {
+		log.Println("warning: lockout is enabled but there are no trusted " +
+			"proxies: clients behind reverse proxy are locked out together")
+	}
+
+	// run scheduler which moves due notifications to outbox
+	if t.Scheduler == nil {
+		t.Scheduler = NewScheduler(t.Storage, t.Outbox)
+	}
+
+	go t.Scheduler.Run(ctx)
+
+	// run go-routing for long polling or register webhook
 	if t.Polling {
 		log.Println("poling:", t.Polling)
 		log.Println("timeout: ", t.Timeout)
 
-		go t.PollUpdates()
+		// updates are not delivered with long polling while webhook is set
+		if err := (&DeleteWebhook{}).To(ctx, t.Api); err != nil {
+			return err
+		}
+
+		go t.PollUpdates(ctx)
+	} else if len(t.WebhookURL) != 0 {
+		log.Println("webhook:", redact(t.WebhookURL, t.Api.GetToken()))
+
+		if err := t.SetWebhook(ctx); err != nil {
+			return err
+		}
+
+		t.updates = make(chan Update, 100)
+		go t.ConsumeUpdates(ctx)
 	}
 
 	// run http server
 	mux := http.NewServeMux()
+	mux.HandleFunc("/api/notify", t.HandleNotifyRequest)
 	mux.HandleFunc("/api/notify/", t.HandleNotifyRequest)
+	mux.HandleFunc("/api/edit/", t.HandleEditRequest)
+	mux.HandleFunc("/api/messages/", t.HandleMessageRequest)
+	mux.HandleFunc("/api/scheduled/", t.HandleScheduledRequest)
+	mux.HandleFunc("/api/tokens/rotate", t.HandleRotateRequest)
 	mux.HandleFunc("/api/ping/", t.HandlePingRequest)
-	mux.HandleFunc("/api/webhook/"+t.Api.GetToken(), t.HandleWebhookRequest)
+	mux.HandleFunc("/api/admin/dead-letters/", t.HandleDeadLettersRequest)
+	mux.HandleFunc("/api/admin/lockouts/", t.HandleLockoutsRequest)
+	mux.HandleFunc("/api/webhook/", t.HandleWebhookRequest)
 
 	srv := http.Server{
-		Addr:    ":8080",
-		Handler: mux,
+		Addr:        ":8080",
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	// wait for in-flight requests on shutdown
+	go func() {
+		<-ctx.Done()
+		log.Println("shut down http server")
+		timeout, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := srv.Shutdown(timeout); err != nil {
+			log.Println("error:", err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
 	}
 
-	return srv.ListenAndServe()
+	return nil
 }
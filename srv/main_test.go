@@ -0,0 +1,509 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestToken(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/notify/1234", nil)
+
+	if token := RequestToken(req); token != "1234" {
+		t.Error("wrong token in path: ", token)
+	}
+
+	req = httptest.NewRequest("POST", "/api/notify", nil)
+	req.Header.Set("Authorization", "Bearer 5678")
+
+	if token := RequestToken(req); token != "5678" {
+		t.Error("wrong token in authorization header: ", token)
+	}
+
+	req = httptest.NewRequest("POST", "/api/edit/abcd", nil)
+	req.Header.Set("X-Telepyth-Token", "5678")
+
+	if token := RequestToken(req); token != "5678" {
+		t.Error("wrong token in header: ", token)
+	} else if id := requestReceiptId(req); id != "abcd" {
+		t.Error("wrong receipt: ", id)
+	}
+
+	req = httptest.NewRequest("POST", "/api/edit/1234/abcd", nil)
+
+	if id := requestReceiptId(req); id != "abcd" {
+		t.Error("wrong receipt: ", id)
+	}
+}
+
+func TestFindUserPolicy(t *testing.T) {
+	telepyth, _ := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	ctx := context.Background()
+	user := &User{Id: 1}
+	telepyth.TrustedProxies = []string{"127.0.0.0/8"}
+
+	issue := func(label string, policy TokenPolicy) string {
+		token, err := telepyth.Storage.InsertToken(ctx, user, label, policy)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	find := func(token, addr string) int {
+		req := httptest.NewRequest("POST", "/api/notify", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = "127.0.0.1:4242"
+		req.Header.Set("X-Forwarded-For", addr)
+
+		if _, err := telepyth.FindUser(httptest.NewRecorder(), req); err != nil {
+			return err.(*httpError).Status
+		}
+
+		return http.StatusOK
+	}
+
+	expired := issue("expired", TokenPolicy{ExpiresAt: time.Now().Add(-time.Hour)})
+	once := issue("once", TokenPolicy{MaxUses: 1})
+	ci := issue("ci", TokenPolicy{Kinds: []string{KindText}, Networks: []string{"10.0.0.0/8"}})
+
+	if status := find(expired, "10.0.0.1"); status != http.StatusUnauthorized {
+		t.Error("expired token is accepted: ", status)
+	}
+
+	notify := func(token, body, key string) int {
+		req := httptest.NewRequest("POST", "/api/notify", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		rec := httptest.NewRecorder()
+		telepyth.HandleNotifyRequest(rec, req)
+		return rec.Code
+	}
+
+	// only accepted notifications use one-time token up and retry of the
+	// same notification is not counted
+	if status := notify(once, `{"text": `, "a"); status != http.StatusBadRequest {
+		t.Error("malformed notification is accepted: ", status)
+	} else if find(once, "10.0.0.1") != http.StatusOK {
+		t.Error("one-time token is used up by authentication")
+	} else if status := notify(once, `{"text": "Loss"}`, "b"); status != http.StatusOK {
+		t.Error("one-time token is not accepted: ", status)
+	} else if status := notify(once, `{"text": "Loss"}`, "b"); status != http.StatusOK {
+		t.Error("retry with one-time token is not accepted: ", status)
+	} else if status := notify(once, `{"text": "Loss"}`, "c"); status != http.StatusUnauthorized {
+		t.Error("one-time token is accepted twice: ", status)
+	}
+
+	// client could not tell wrong address from wrong token
+	if status := find(ci, "192.168.0.1"); status != http.StatusUnauthorized {
+		t.Error("token is accepted from wrong address: ", status)
+	} else if status := find(ci, "10.1.2.3"); status != http.StatusOK {
+		t.Error("token is not accepted from runner: ", status)
+	}
+
+	// token could send text only
+	body := `{"attachments": [{"kind": "photo", "data": "UE5H"}]}`
+	req := httptest.NewRequest("POST", "/api/notify", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+ci)
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = "10.0.0.1:4242"
+	rec := httptest.NewRecorder()
+	telepyth.HandleNotifyRequest(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Error("photo is sent with text token: ", rec.Code)
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	telepyth, _ := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	ctx := context.Background()
+	user := &User{Id: 1}
+	token, err := telepyth.Storage.InsertToken(ctx, user, "ci", TokenPolicy{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func(token, grace string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/tokens/rotate?grace="+grace, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		telepyth.HandleRotateRequest(rec, req)
+		return rec
+	}
+
+	rec := rotate(token, "1h")
+	res := &RotateResponse{}
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("token is not rotated: ", rec.Code)
+	} else if err := json.NewDecoder(rec.Body).Decode(res); err != nil {
+		t.Fatal(err)
+	} else if res.Label != "ci" || res.Token == token {
+		t.Error("wrong replacement of token: ", res)
+	}
+
+	// old token works within grace period with warning
+	req := httptest.NewRequest("POST", "/api/notify", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec = httptest.NewRecorder()
+
+	if _, err := telepyth.FindUser(rec, req); err != nil {
+		t.Error("rotated token is rejected within grace period: ", err)
+	} else if rec.Header().Get("Deprecation") != "true" {
+		t.Error("rotated token is not deprecated")
+	}
+
+	if rec := rotate(token, ""); rec.Code != http.StatusConflict {
+		t.Error("token is rotated twice: ", rec.Code)
+	}
+
+	if latest, err := telepyth.Storage.SelectTokenBy(ctx, user); err != nil || latest != telepyth.Storage.HashToken(res.Token) {
+		t.Error("replacement is not the latest token: ", latest, err)
+	}
+
+	// replacement is rejected at once if there is no grace period
+	if rec := rotate(res.Token, "0"); rec.Code != http.StatusOK {
+		t.Fatal("token is not rotated: ", rec.Code)
+	}
+
+	req.Header.Set("Authorization", "Bearer "+res.Token)
+
+	if _, err := telepyth.FindUser(httptest.NewRecorder(), req); err == nil {
+		t.Error("rotated token is accepted after grace period")
+	}
+}
+
+func TestRotateTokenUses(t *testing.T) {
+	telepyth, _ := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	ctx := context.Background()
+	user := &User{Id: 1}
+	token, err := telepyth.Storage.InsertToken(ctx, user, "ci", TokenPolicy{MaxUses: 2})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notify := func(token string) int {
+		req := httptest.NewRequest("POST", "/api/notify", strings.NewReader("Loss"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		rec := httptest.NewRecorder()
+		telepyth.HandleNotifyRequest(rec, req)
+		return rec.Code
+	}
+
+	if status := notify(token); status != http.StatusOK {
+		t.Fatal("token is not accepted: ", status)
+	}
+
+	replacement, err := telepyth.Storage.RotateToken(ctx, token, time.Now().Add(time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// old token and its replacement share uses during grace period
+	if status := notify(token); status != http.StatusOK {
+		t.Error("rotated token is not accepted: ", status)
+	} else if status := notify(replacement); status != http.StatusUnauthorized {
+		t.Error("replacement is accepted after uses are over: ", status)
+	} else if status := notify(token); status != http.StatusUnauthorized {
+		t.Error("rotated token is accepted after uses are over: ", status)
+	}
+}
+
+func TestRotateTokenOwnership(t *testing.T) {
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 7}}`))
+	})
+
+	ctx := context.Background()
+	request := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		rec := httptest.NewRecorder()
+
+		if strings.HasPrefix(path, "/api/edit/") {
+			telepyth.HandleEditRequest(rec, req)
+		} else if strings.HasPrefix(path, "/api/scheduled/") {
+			telepyth.HandleScheduledRequest(rec, req)
+		} else {
+			telepyth.HandleNotifyRequest(rec, req)
+		}
+
+		return rec
+	}
+
+	// notifications are sent and scheduled with the old token
+	sent, scheduled := &Receipt{}, &Receipt{}
+
+	if rec := request("POST", "/api/notify", token, "epoch 1"); rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	} else if err := json.NewDecoder(rec.Body).Decode(sent); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := request("POST", "/api/notify?delay=6h", token, "check"); rec.Code != http.StatusAccepted {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	} else if err := json.NewDecoder(rec.Body).Decode(scheduled); err != nil {
+		t.Fatal(err)
+	}
+
+	replacement, err := telepyth.Storage.RotateToken(ctx, token, time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replacement owns whatever the old token has created
+	if rec := request("POST", "/api/edit/"+sent.Id, replacement, "epoch 2"); rec.Code != http.StatusOK {
+		t.Error("replacement could not edit message: ", rec.Code, rec.Body.String())
+	}
+
+	notifications := []*Notification{}
+
+	if rec := request("GET", "/api/scheduled/", replacement, ""); rec.Code != http.StatusOK {
+		t.Error("wrong status: ", rec.Code)
+	} else if err := json.NewDecoder(rec.Body).Decode(&notifications); err != nil {
+		t.Error(err)
+	} else if len(notifications) != 1 || notifications[0].ReceiptId != scheduled.Id {
+		t.Error("wrong scheduled notifications: ", notifications)
+	}
+
+	if rec := request("DELETE", "/api/scheduled/"+scheduled.Id, replacement, ""); rec.Code != http.StatusOK {
+		t.Error("replacement could not cancel notification: ", rec.Code, rec.Body.String())
+	}
+
+	// token of another lineage owns nothing
+	other, err := telepyth.Storage.InsertToken(ctx, &User{Id: 1}, "ci", TokenPolicy{})
+
+	if err != nil {
+		t.Fatal(err)
+	} else if rec := request("POST", "/api/edit/"+sent.Id, other, "epoch 3"); rec.Code != http.StatusNotFound {
+		t.Error("message is edited with another token: ", rec.Code)
+	}
+}
+
+func TestFindUserLockout(t *testing.T) {
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	telepyth.AdminToken = "secret"
+	telepyth.Lockout = &Lockout{
+		Threshold: 3,
+		Delay:     time.Minute,
+		MaxDelay:  time.Hour,
+		Window:    time.Hour,
+	}
+
+	find := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/notify", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = "10.0.0.1:4242"
+		rec := httptest.NewRecorder()
+
+		if _, err := telepyth.FindUser(rec, req); err != nil {
+			rec.Code, _ = errorReport(rec, err)
+		}
+
+		return rec
+	}
+
+	for i := 0; i != 3; i++ {
+		if rec := find("tp_guess"); rec.Code != http.StatusUnauthorized {
+			t.Fatal("wrong status of unknown token: ", rec.Code)
+		}
+	}
+
+	// valid token is rejected as well while address is locked out
+	if rec := find(token); rec.Code != http.StatusTooManyRequests {
+		t.Fatal("address is not locked out: ", rec.Code)
+	} else if len(rec.Header().Get("Retry-After")) == 0 {
+		t.Error("there is no Retry-After header")
+	}
+
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		telepyth.HandleLockoutsRequest(rec, req)
+		return rec
+	}
+
+	stats := &LockoutStats{}
+
+	if rec := admin("GET", "/api/admin/lockouts/"); rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code)
+	} else if err := json.NewDecoder(rec.Body).Decode(stats); err != nil {
+		t.Fatal(err)
+	} else if stats.Failures != 3 || stats.Lockouts != 1 || stats.Rejected != 1 ||
+		len(stats.Locked) != 1 || stats.Locked[0].Addr != "10.0.0.1" {
+		t.Error("wrong stats: ", stats)
+	}
+
+	if rec := admin("DELETE", "/api/admin/lockouts/10.0.0.1"); rec.Code != http.StatusNoContent {
+		t.Fatal("lockout is not cleared: ", rec.Code)
+	} else if rec := find(token); rec.Code != http.StatusOK {
+		t.Error("token is rejected after lockout is cleared: ", rec.Code)
+	}
+
+	// every next lockout is twice as long
+	now := time.Now()
+	lockout := telepyth.Lockout
+
+	for i, expected := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		for j := 0; j != lockout.Threshold-1; j++ {
+			lockout.Fail("10.0.0.2", now)
+		}
+
+		if delay := lockout.Fail("10.0.0.2", now); delay != expected {
+			t.Error("wrong delay of lockout ", i, ": ", delay)
+		}
+	}
+
+	// admin token is guarded by lockout too
+	guess := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/admin/lockouts/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.RemoteAddr = "10.0.0.3:4242"
+		rec := httptest.NewRecorder()
+		telepyth.HandleLockoutsRequest(rec, req)
+		return rec
+	}
+
+	for i := 0; i != 3; i++ {
+		if rec := guess("guess"); rec.Code != http.StatusNotFound {
+			t.Fatal("wrong status of wrong admin token: ", rec.Code)
+		}
+	}
+
+	if rec := guess("secret"); rec.Code != http.StatusNotFound {
+		t.Error("admin token is accepted from locked out address: ", rec.Code)
+	} else if rec := admin("GET", "/api/admin/lockouts/"); rec.Code != http.StatusOK {
+		t.Error("admin token is rejected from another address: ", rec.Code)
+	}
+}
+
+func TestHandleEditRequest(t *testing.T) {
+	type call struct {
+		method string
+		body   map[string]interface{}
+	}
+
+	calls := make(chan call, 10)
+
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		body := map[string]interface{}{}
+		json.NewDecoder(req.Body).Decode(&body)
+		calls <- call{req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:], body}
+
+		// markup is malformed unless it is sent as plain text
+		if _, ok := body["parse_mode"]; ok && strings.Contains(req.URL.Path, "Text") {
+			w.Write([]byte(`{"ok": false, "error_code": 400, "description": ` +
+				`"Bad Request: can't parse entities"}`))
+			return
+		}
+
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 7}}`))
+	})
+
+	ctx := context.Background()
+	deliver := func(media bool) *Receipt {
+		n := &Notification{
+			Token:       telepyth.Storage.HashToken(token),
+			ChatId:      1,
+			Text:        "epoch 1",
+			NextAttempt: time.Now().Add(time.Hour),
+		}
+
+		if media {
+			n.Attachments = []Attachment{{Kind: KindPhoto, Data: []byte("PNG")}}
+		}
+
+		n.MessageId = 7
+
+		if err := telepyth.Storage.PutNotification(ctx, n); err != nil {
+			t.Fatal(err)
+		} else if err := telepyth.Storage.CompleteNotification(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+
+		receipt, err := telepyth.Storage.SelectReceipt(ctx, n.ReceiptId)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return receipt
+	}
+
+	edit := func(receipt *Receipt, query string) (*httptest.ResponseRecorder, call) {
+		req := httptest.NewRequest("POST", "/api/edit/"+receipt.Id+query,
+			strings.NewReader("epoch *2*"))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		telepyth.HandleEditRequest(rec, req)
+
+		select {
+		case c := <-calls:
+			return rec, c
+		default:
+			return rec, call{}
+		}
+	}
+
+	// text is edited without formatting since markup is rejected
+	text := deliver(false)
+	rec, c := edit(text, "")
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	} else if c.method != "editMessageText" || c.body["message_id"] != float64(7) {
+		t.Error("wrong request: ", c)
+	} else if c := <-calls; c.body["text"] != "epoch *2*" || c.body["parse_mode"] != nil {
+		t.Error("wrong fallback request: ", c)
+	}
+
+	if receipt, err := telepyth.Storage.SelectReceipt(ctx, text.Id); err != nil {
+		t.Fatal(err)
+	} else if !receipt.Fallback || !receipt.UpdatedAt.After(text.UpdatedAt) {
+		t.Error("edit is not recorded in receipt: ", receipt)
+	}
+
+	// caption is not formatted unless client asks
+	photo := deliver(true)
+	rec, c = edit(photo, "?parse_mode=markdown")
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	} else if c.method != "editMessageCaption" || c.body["caption"] != "epoch *2*" ||
+		c.body["parse_mode"] != "Markdown" {
+		t.Error("wrong request: ", c)
+	}
+
+	if receipt, err := telepyth.Storage.SelectReceipt(ctx, photo.Id); err != nil {
+		t.Fatal(err)
+	} else if receipt.Fallback || !receipt.UpdatedAt.After(photo.UpdatedAt) {
+		t.Error("edit is not recorded in receipt: ", receipt)
+	}
+}
@@ -0,0 +1,421 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxBatchSize is the largest number of messages in batch request.
+const maxBatchSize = 100
+
+// maxJSONRequest is the largest body of JSON notify request. Attachments are
+// encoded with base64, so it is a bit larger than limit of multipart form.
+const maxJSONRequest = 16 * 1024 * 1024
+
+// NotifyRequest is a body of JSON notify request. Text is used as caption if
+// there are attachments. Notification replies to message which is referred
+// by receipt in ReplyTo. Either SendAt or Delay schedules notification.
+type NotifyRequest struct {
+	Text                  string             `json:"text"`
+	ParseMode             string             `json:"parse_mode"`
+	DisableNotification   bool               `json:"disable_notification"`
+	DisableWebPagePreview bool               `json:"disable_web_page_preview"`
+	ProtectContent        bool               `json:"protect_content"`
+	ReplyTo               string             `json:"reply_to"`
+	Tags                  []string           `json:"tags"`
+	Priority              string             `json:"priority"`
+	SendAt                string             `json:"send_at"`
+	Delay                 string             `json:"delay"`
+	Attachments           []NotifyAttachment `json:"attachments"`
+}
+
+// NotifyAttachment is a file in JSON notify request. Its content is encoded
+// with base64.
+type NotifyAttachment struct {
+	Kind        string `json:"kind"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Data        []byte `json:"data"`
+}
+
+// HandleJSONNotifyRequest sends notification which is described in JSON.
+// Errors are reported in JSON as well.
+func (t *TelePyth) HandleJSONNotifyRequest(w http.ResponseWriter, req *http.Request) error {
+	user, err := t.FindUser(w, req)
+
+	if err != nil {
+		return err
+	}
+
+	body := &NotifyRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxJSONRequest))
+
+	if err := decoder.Decode(body); err != nil {
+		return &httpError{http.StatusBadRequest, "malformed request: " + err.Error()}
+	}
+
+	n, err := t.notification(req, user, body)
+
+	if err != nil {
+		return err
+	}
+
+	return t.push(w, req, n)
+}
+
+// notification makes notification from JSON request. Options which are not
+// set in request are taken from headers and query of HTTP request.
+func (t *TelePyth) notification(req *http.Request, user *User, body *NotifyRequest) (*Notification, error) {
+	if len(body.Text) == 0 && len(body.Attachments) == 0 {
+		return nil, &httpError{http.StatusBadRequest, "neither text nor attachments"}
+	} else if len(body.Priority) != 0 && !IsPriority(body.Priority) {
+		return nil, &httpError{http.StatusBadRequest, "wrong priority"}
+	}
+
+	priority, err := RequestPriority(req)
+
+	if err != nil {
+		return nil, err
+	} else if len(body.Priority) != 0 {
+		priority = body.Priority
+	}
+
+	// caption is not formatted unless client asks
+	parseMode := ""
+
+	if len(body.Attachments) == 0 {
+		parseMode = "Markdown"
+	}
+
+	parseMode, err = RequestParseMode(req, parseMode)
+
+	if err != nil {
+		return nil, err
+	} else if len(body.ParseMode) != 0 {
+		var ok bool
+
+		if parseMode, ok = parseModes[strings.ToLower(body.ParseMode)]; !ok {
+			return nil, &httpError{http.StatusBadRequest, "wrong parse mode"}
+		}
+	}
+
+	policy, err := t.LongMessagePolicy(req, user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sendAt, err := RequestSendAt(req)
+
+	if len(body.SendAt) != 0 || len(body.Delay) != 0 {
+		sendAt, err = parseSendAt(body.SendAt, body.Delay)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Notification{
+		Token:                 t.Storage.HashToken(RequestToken(req)),
+		ChatId:                user.Id,
+		ParseMode:             parseMode,
+		LongMessage:           policy,
+		DisableNotification:   body.DisableNotification,
+		DisableWebPagePreview: body.DisableWebPagePreview,
+		ProtectContent:        body.ProtectContent,
+		Priority:              priority,
+		SendAt:                sendAt,
+	}
+
+	// tags are appended to text as hashtags
+	text := body.Text
+
+	for i, tag := range body.Tags {
+		tag = strings.TrimPrefix(tag, "#")
+
+		if !isTag(tag) {
+			return nil, &httpError{http.StatusBadRequest, "wrong tag"}
+		} else if i == 0 {
+			text += "\n\n"
+		} else {
+			text += " "
+		}
+
+		n.Tags = append(n.Tags, tag)
+		text += escapeTag("#"+tag, parseMode)
+	}
+
+	text = strings.TrimLeft(text, "\n")
+
+	if len(body.ReplyTo) != 0 {
+		receipt, err := t.Storage.SelectReceipt(req.Context(), body.ReplyTo)
+
+		if err != nil || !t.Storage.SameLineage(req.Context(), receipt.Token, n.Token) ||
+			receipt.State != StateSent {
+			return nil, &httpError{http.StatusUnprocessableEntity, "unknown reply_to"}
+		}
+
+		n.ReplyToMessageId = receipt.MessageId
+	}
+
+	for _, attachment := range body.Attachments {
+		if attachment.Kind != KindPhoto && attachment.Kind != KindDocument {
+			return nil, &httpError{http.StatusBadRequest, "wrong kind of attachment"}
+		} else if len(attachment.Data) == 0 {
+			return nil, &httpError{http.StatusBadRequest, "empty attachment"}
+		}
+
+		n.Attachments = append(n.Attachments, Attachment{
+			Kind:        attachment.Kind,
+			FileName:    attachment.FileName,
+			ContentType: attachment.ContentType,
+			Data:        attachment.Data,
+		})
+	}
+
+	// count send_message, send_figure and send_document events
+	events := map[string]bool{}
+
+	for _, attachment := range n.Attachments {
+		if attachment.Kind == KindPhoto {
+			events["send_figure"] = true
+		} else {
+			events["send_document"] = true
+		}
+	}
+
+	if len(n.Attachments) == 0 {
+		n.Text = text
+		events["send_message"] = true
+	} else {
+		n.Caption = text
+	}
+
+	for event := range events {
+		EnqueueLogRecord(user.Id, event)
+	}
+
+	return n, nil
+}
+
+// BatchResult is an outcome of a message of batch request. It contains either
+// receipt or error. Status is the same as if message was sent alone.
+type BatchResult struct {
+	Status  int      `json:"status"`
+	Receipt *Receipt `json:"receipt,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// HandleBatchNotifyRequest sends several notifications which are described in
+// JSON array. Notifications are queued in order, and invalid ones do not
+// prevent others from sending. Response contains result for every message.
+func (t *TelePyth) HandleBatchNotifyRequest(w http.ResponseWriter, req *http.Request) error {
+	user, err := t.FindUser(w, req)
+
+	if err != nil {
+		return err
+	}
+
+	bodies := []NotifyRequest{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxJSONRequest))
+
+	if err := decoder.Decode(&bodies); err != nil {
+		return &httpError{http.StatusBadRequest, "malformed request: " + err.Error()}
+	} else if len(bodies) == 0 || len(bodies) > maxBatchSize {
+		return &httpError{http.StatusBadRequest, "wrong number of messages"}
+	}
+
+	timeout, final, err := parseWait(req)
+
+	if err != nil {
+		return err
+	}
+
+	key := req.Header.Get("Idempotency-Key")
+
+	if len(key) > maxIdempotencyKey {
+		return &httpError{http.StatusBadRequest, "idempotency key is too long"}
+	}
+
+	type pending struct {
+		index        int
+		notification *Notification
+		ch           <-chan Attempt
+		stop         func()
+	}
+
+	results := make([]BatchResult, len(bodies))
+	pushed := []pending{}
+
+	for i := range bodies {
+		n, err := t.notification(req, user, &bodies[i])
+
+		if err != nil {
+			results[i] = t.batchResult(w, req, nil, err)
+			continue
+		}
+
+		// every message is retried separately
+		if len(key) != 0 {
+			n.IdempotencyKey = key + "/" + strconv.Itoa(i)
+		}
+
+		ch, stop, err := t.accept(req.Context(), n)
+
+		var httpErr *httpError
+
+		if errors.Is(err, ErrRepeatedRequest) {
+			results[i] = t.batchResult(w, req, n, nil)
+		} else if errors.As(err, &httpErr) {
+			results[i] = t.batchResult(w, req, nil, err)
+		} else if err != nil {
+			log.Println("error:", err)
+			results[i] = t.batchResult(w, req, nil, errorStatus(http.StatusInternalServerError))
+		} else if ch == nil {
+			// scheduled or held message is not awaited
+			results[i] = t.batchResult(w, req, n, nil)
+		} else {
+			pushed = append(pushed, pending{i, n, ch, stop})
+		}
+	}
+
+	// wait for all messages at once
+	deadline := time.Now().Add(timeout)
+
+	for _, p := range pushed {
+		n := p.notification
+		attempt := t.Outbox.Await(req.Context(), n.Id, p.ch, p.stop,
+			time.Until(deadline), final)
+
+		if attempt != nil && attempt.Final && attempt.Err != nil {
+			results[p.index] = t.batchResult(w, req, n, attempt.Err)
+		} else {
+			results[p.index] = t.batchResult(w, req, n, nil)
+		}
+	}
+
+	writeJSON(w, http.StatusOK, results)
+	return nil
+}
+
+// accept either schedules notification, holds it for digest or puts it into
+// outbox. Notification is marked with label of its token, and its content
+// should be allowed by policy of the token. Quiet hours of user either
+// silence notification or postpone it. Use of token is counted along with
+// storing notification. It returns channel of delivery attempts only if
+// notification is put into outbox.
+func (t *TelePyth) accept(ctx context.Context, n *Notification) (<-chan Attempt, func(), error) {
+	if ut, err := t.Storage.SelectHashedToken(ctx, n.Token); err != nil {
+		return nil, nil, err
+	} else if !ut.Policy.AllowsContent(n) {
+		return nil, nil, &httpError{http.StatusForbidden, "content is not allowed"}
+	} else {
+		n.Label = ut.Label
+	}
+
+	prefs, err := t.Storage.SelectPreferences(ctx, &User{Id: n.ChatId})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ch <-chan Attempt
+	var stop func()
+
+	// digest is sent with respect to quiet hours
+	if !n.SendAt.After(time.Now()) && n.digestible() && prefs.IsDigest() {
+		err = t.Scheduler.Hold(ctx, n)
+	} else {
+		// critical alerts are sent with urgent priority at any time
+		if n.priority() != PriorityUrgent {
+			prefs.quiet(n, time.Now())
+		}
+
+		if n.SendAt.After(time.Now()) {
+			err = t.Scheduler.Schedule(ctx, n)
+		} else {
+			ch, stop, err = t.Outbox.Push(ctx, n)
+		}
+	}
+
+	// client could not tell used up token from any other wrong one
+	if errors.Is(err, ErrTokenUsedUp) {
+		log.Println("token of user", n.ChatId, "is used up")
+		return nil, nil, errorStatus(http.StatusUnauthorized)
+	}
+
+	return ch, stop, err
+}
+
+// batchResult makes result of a message of batch request from notification
+// and from error.
+func (t *TelePyth) batchResult(w http.ResponseWriter, req *http.Request, n *Notification, err error) BatchResult {
+	result := BatchResult{}
+
+	if n != nil {
+		if receipt, err := t.Storage.SelectReceipt(req.Context(), n.ReceiptId); err != nil {
+			log.Println("error:", err)
+		} else {
+			result.Receipt = receipt
+			result.Status = receiptStatus(receipt)
+		}
+	}
+
+	if err != nil {
+		result.Status, result.Error = errorReport(w, err)
+	} else if result.Receipt == nil {
+		result.Status = http.StatusInternalServerError
+		result.Error = http.StatusText(result.Status)
+	}
+
+	return result
+}
+
+// isTag reports whether tag is a valid hashtag.
+func isTag(tag string) bool {
+	if len(tag) == 0 {
+		return false
+	}
+
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// markdownV2Reserved is a set of characters which must be escaped anywhere in
+// MarkdownV2 text.
+const markdownV2Reserved = "\\_*[]()~`>#+-=|{}.!"
+
+// escapeTag escapes hashtag in the given parse mode. Underscores start italic
+// text in Markdown while MarkdownV2 reserves a lot more characters including
+// hash sign itself.
+func escapeTag(tag, parseMode string) string {
+	switch parseMode {
+	case "MarkdownV2":
+		builder := strings.Builder{}
+
+		for _, r := range tag {
+			if strings.ContainsRune(markdownV2Reserved, r) {
+				builder.WriteByte('\\')
+			}
+			builder.WriteRune(r)
+		}
+
+		return builder.String()
+	case "Markdown", ParseModeCommonMark:
+		return strings.ReplaceAll(tag, "_", "\\_")
+	default:
+		return tag
+	}
+}
@@ -0,0 +1,263 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTelePyth makes server which sends requests to handler instead of Bot
+// API. It returns server and access token of user.
+func newTestTelePyth(t *testing.T, handler http.HandlerFunc) (*TelePyth, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	file, err := ioutil.TempFile("", "boltdb-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := NewStorage(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	t.Cleanup(func() {
+		cancel()
+		storage.Close()
+		os.Remove(file.Name())
+		os.Remove(TokenKeyPath(file.Name()))
+	})
+
+	token, err := storage.InsertUser(ctx, &User{Id: 1}, time.Now())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// events are not logged in test
+	go func() {
+		for range logCh {
+		}
+	}()
+
+	dispatcher := NewDispatcher(New("42:token", WithEndpoint(server.URL)))
+	dispatcher.ChatInterval = 10 * time.Millisecond
+	telepyth := &TelePyth{
+		Storage:    storage,
+		Dispatcher: dispatcher,
+		Outbox:     NewOutbox(storage, dispatcher),
+	}
+	telepyth.Scheduler = NewScheduler(storage, telepyth.Outbox)
+	telepyth.Scheduler.PollInterval = 10 * time.Millisecond
+
+	go dispatcher.Run(ctx)
+	go telepyth.Outbox.Run(ctx)
+	go telepyth.Scheduler.Run(ctx)
+
+	return telepyth, token
+}
+
+func TestHandleJSONNotifyRequest(t *testing.T) {
+	messages := make(chan SendMessage, 1)
+
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		msg := SendMessage{}
+		json.NewDecoder(req.Body).Decode(&msg)
+		messages <- msg
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	request := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/notify/"+token, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		rec := httptest.NewRecorder()
+		telepyth.HandleNotifyRequest(rec, req)
+		return rec
+	}
+
+	// errors are reported in JSON
+	rec := request(`{"text": "Loss", "priority": "asap"}`)
+	res := &Response{}
+
+	if rec.Code != http.StatusBadRequest {
+		t.Error("wrong status: ", rec.Code)
+	} else if err := json.NewDecoder(rec.Body).Decode(res); err != nil {
+		t.Error(err)
+	} else if res.Ok || res.ErrorCode != http.StatusBadRequest {
+		t.Error("wrong error: ", res)
+	}
+
+	rec = request(`{"text": "Loss", "tags": ["run_1"], "priority": "urgent",
+		"disable_notification": true}`)
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.Text != "Loss\n\n#run\\_1" || !msg.DisableNotification {
+			t.Error("wrong message: ", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("message is not sent")
+	}
+
+	// hash sign and underscores are reserved in MarkdownV2
+	rec = request(`{"text": "Loss\\.", "tags": ["#run_1"],
+		"parse_mode": "MarkdownV2"}`)
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.Text != "Loss\\.\n\n\\#run\\_1" || msg.ParseMode != "MarkdownV2" {
+			t.Error("wrong message: ", msg)
+		}
+	case <-time.After(time.Second):
+		t.Error("message is not sent")
+	}
+}
+
+func TestHandleBatchNotifyRequest(t *testing.T) {
+	messages := make(chan SendMessage, 10)
+
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		msg := SendMessage{}
+		json.NewDecoder(req.Body).Decode(&msg)
+		messages <- msg
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	body := `[
+		{"text": "accuracy 0.91"},
+		{"text": "f1 0.88", "priority": "asap"},
+		{"text": "<b>recall</b> 0.86", "parse_mode": "html"}
+	]`
+
+	req := httptest.NewRequest("POST", "/api/notify/batch", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	telepyth.HandleNotifyRequest(rec, req)
+
+	results := []BatchResult{}
+
+	if rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+	} else if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+
+	// invalid message does not prevent others from sending
+	expected := []int{http.StatusOK, http.StatusBadRequest, http.StatusOK}
+
+	for i, result := range results {
+		if result.Status != expected[i] {
+			t.Error("wrong status of message: ", i, result)
+		}
+	}
+
+	// messages are sent in order
+	if msg := <-messages; msg.Text != "accuracy 0.91" {
+		t.Error("wrong first message: ", msg.Text)
+	} else if msg := <-messages; msg.Text != "<b>recall</b> 0.86" || msg.ParseMode != "HTML" {
+		t.Error("wrong second message: ", msg)
+	}
+}
+
+func TestHandleScheduledRequest(t *testing.T) {
+	messages := make(chan SendMessage, 10)
+
+	telepyth, token := newTestTelePyth(t, func(w http.ResponseWriter, req *http.Request) {
+		msg := SendMessage{}
+		json.NewDecoder(req.Body).Decode(&msg)
+		messages <- msg
+		w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+	})
+
+	schedule := func(text, delay string) *Receipt {
+		req := httptest.NewRequest("POST", "/api/notify?delay="+delay, strings.NewReader(text))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "text/plain")
+		rec := httptest.NewRecorder()
+		telepyth.HandleNotifyRequest(rec, req)
+
+		receipt := &Receipt{}
+
+		if rec.Code != http.StatusAccepted {
+			t.Fatal("wrong status: ", rec.Code, rec.Body.String())
+		} else if err := json.NewDecoder(rec.Body).Decode(receipt); err != nil {
+			t.Fatal(err)
+		} else if receipt.State != StateScheduled || receipt.SendAt == nil {
+			t.Fatal("wrong receipt: ", receipt)
+		}
+
+		return receipt
+	}
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		telepyth.HandleScheduledRequest(rec, req)
+		return rec
+	}
+
+	later := schedule("check the run", "6h")
+	soon := schedule("epoch 1 is done", "1s")
+
+	// notifications are listed in order of sending
+	notifications := []*Notification{}
+
+	if rec := request("GET", "/api/scheduled/"); rec.Code != http.StatusOK {
+		t.Fatal("wrong status: ", rec.Code)
+	} else if err := json.NewDecoder(rec.Body).Decode(&notifications); err != nil {
+		t.Fatal(err)
+	} else if len(notifications) != 2 || notifications[0].ReceiptId != soon.Id {
+		t.Error("wrong scheduled notifications: ", notifications)
+	}
+
+	select {
+	case msg := <-messages:
+		if msg.Text != "epoch 1 is done" {
+			t.Error("wrong message: ", msg.Text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("scheduled message is not sent")
+	}
+
+	if rec := request("DELETE", "/api/scheduled/"+later.Id); rec.Code != http.StatusOK {
+		t.Error("wrong status: ", rec.Code, rec.Body.String())
+	} else if receipt, _ := telepyth.Storage.SelectReceipt(context.Background(), later.Id); receipt.State != StateCancelled {
+		t.Error("notification is not cancelled: ", receipt.State)
+	}
+
+	// sent notification could not be cancelled
+	if rec := request("DELETE", "/api/scheduled/"+soon.Id); rec.Code != http.StatusNotFound {
+		t.Error("wrong status: ", rec.Code)
+	}
+}
+
+func TestEscapeTag(t *testing.T) {
+	if tag := escapeTag("#run-1.2_a", "MarkdownV2"); tag != "\\#run\\-1\\.2\\_a" {
+		t.Error("wrong MarkdownV2 tag: ", tag)
+	} else if tag := escapeTag("#run_1", "Markdown"); tag != "#run\\_1" {
+		t.Error("wrong Markdown tag: ", tag)
+	} else if tag := escapeTag("#run_1", ""); tag != "#run_1" {
+		t.Error("wrong plain tag: ", tag)
+	}
+}
@@ -0,0 +1,736 @@
+package srv
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/daskol/telepyth/srv/format"
+)
+
+// Notification is a message accepted from user. It is kept in outbox until
+// it is delivered or until it is considered undeliverable.
+type Notification struct {
+	Id        uint64 `json:"id"`
+	ReceiptId string `json:"receipt_id"`
+	Token     string `json:"-"`
+	ChatId    int    `json:"chat_id"`
+
+	// Label is a label of token which notification is sent with.
+	Label string `json:"label,omitempty"`
+
+	// IdempotencyKey is chosen by client in order to retry request safely.
+	// Notification is accepted once per key and token.
+	IdempotencyKey string `json:"-"`
+
+	Text      string `json:"text,omitempty"`
+	ParseMode string `json:"parse_mode,omitempty"`
+	Caption   string `json:"caption,omitempty"`
+
+	// Fallback is set if Bot API could not parse entities, so text is sent
+	// without formatting.
+	Fallback bool `json:"fallback,omitempty"`
+
+	// LongMessage is a policy which is applied to text which is too long to
+	// be sent as a single message.
+	LongMessage string `json:"long_message,omitempty"`
+
+	DisableNotification   bool     `json:"disable_notification,omitempty"`
+	DisableWebPagePreview bool     `json:"disable_web_page_preview,omitempty"`
+	ProtectContent        bool     `json:"protect_content,omitempty"`
+	ReplyToMessageId      int      `json:"reply_to_message_id,omitempty"`
+	Priority              string   `json:"priority,omitempty"`
+	Tags                  []string `json:"tags,omitempty"`
+
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Delivered is number of requests which are already sent. Notification
+	// could require several requests (e.g. a few albums) to be delivered.
+	Delivered int `json:"delivered"`
+	MessageId int `json:"message_id,omitempty"`
+
+	CreatedAt   time.Time `json:"created_at"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+
+	// SendAt is a moment when scheduled notification is moved to outbox.
+	// It is zero if notification is sent immediately.
+	SendAt time.Time `json:"send_at"`
+
+	// Digest lists receipts of notifications which are collected into this
+	// summary.
+	Digest []string `json:"digest,omitempty"`
+}
+
+// ParseModeCommonMark is a parse mode of text which is converted to entities
+// by server rather than by Bot API.
+const ParseModeCommonMark = "CommonMark"
+
+const (
+	KindPhoto    = "photo"
+	KindDocument = "document"
+)
+
+// Attachment is a file attached to notification. It is sent either as photo
+// or as document.
+type Attachment struct {
+	Kind        string `json:"kind"`
+	FileName    string `json:"file_name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Data        []byte `json:"-"`
+}
+
+// maxMediaGroup is the largest number of items in media group.
+const maxMediaGroup = 10
+
+// IsMedia reports whether notification is delivered as a photo or a document
+// rather than as a text message.
+func (n *Notification) IsMedia() bool {
+	if len(n.Attachments) != 0 {
+		return true
+	}
+
+	text, _ := n.format(n.Text)
+	return format.TextLength(text) > maxMessageLength &&
+		n.LongMessage == LongMessageDocument
+}
+
+// Senders converts notification to Bot API requests which deliver it.
+func (n *Notification) Senders() []Sender {
+	senders := n.attachments()
+
+	if len(n.Attachments) == 0 {
+		senders = n.text()
+	}
+
+	for i, sender := range senders {
+		n.options(sender, i == 0)
+	}
+
+	return senders
+}
+
+// options applies delivery options to request. Only the first request
+// replies to message.
+func (n *Notification) options(sender Sender, first bool) {
+	replyTo := 0
+
+	if first {
+		replyTo = n.ReplyToMessageId
+	}
+
+	switch s := sender.(type) {
+	case *SendMessage:
+		s.DisableNotification = n.DisableNotification
+		s.DisableWebPagePreview = n.DisableWebPagePreview
+		s.ProtectContent = n.ProtectContent
+		s.ReplyToMessageId = replyTo
+	case *SendPhoto:
+		s.DisableNotification = n.DisableNotification
+		s.ProtectContent = n.ProtectContent
+		s.ReplyToMessageId = replyTo
+	case *SendDocument:
+		s.DisableNotification = n.DisableNotification
+		s.ProtectContent = n.ProtectContent
+		s.ReplyToMessageId = replyTo
+	case *SendMediaGroup:
+		s.DisableNotification = n.DisableNotification
+		s.ProtectContent = n.ProtectContent
+		s.ReplyToMessageId = replyTo
+	}
+}
+
+// priorities maps priority of notification on priority of request.
+var priorities = map[string]Priority{
+	"low":    PriorityBulk,
+	"normal": PriorityNotify,
+	"urgent": PriorityUrgent,
+}
+
+// IsPriority reports whether priority of notification is known.
+func IsPriority(priority string) bool {
+	_, ok := priorities[priority]
+	return ok
+}
+
+// priority returns priority of requests which deliver notification. It is
+// normal by default.
+func (n *Notification) priority() Priority {
+	if priority, ok := priorities[n.Priority]; ok {
+		return priority
+	}
+
+	return PriorityNotify
+}
+
+// attachments makes requests which deliver attachments. Several attachments
+// are sent as albums. Photos and documents are sent in separate albums since
+// they could not be mixed. Caption is attached to the first item.
+func (n *Notification) attachments() []Sender {
+	if len(n.Attachments) == 0 {
+		return nil
+	}
+
+	groups := [][]Attachment{}
+
+	for _, kind := range []string{KindPhoto, KindDocument} {
+		group := []Attachment{}
+
+		for _, attachment := range n.Attachments {
+			if attachment.Kind != kind {
+				continue
+			}
+
+			if len(group) == maxMediaGroup {
+				groups = append(groups, group)
+				group = []Attachment{}
+			}
+
+			group = append(group, attachment)
+		}
+
+		if len(group) != 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	senders := []Sender{}
+	caption := n.Caption
+
+	for _, group := range groups {
+		senders = append(senders, n.group(group, caption))
+		caption = ""
+	}
+
+	return senders
+}
+
+// text makes requests which deliver text. Text which does not fit a single
+// message is either split into several messages or is sent as a text file.
+func (n *Notification) text() []Sender {
+	text, entities := n.format(n.Text)
+
+	if format.TextLength(text) <= maxMessageLength {
+		return []Sender{&SendMessage{
+			ChatId:    n.ChatId,
+			Text:      text,
+			ParseMode: n.parseMode(),
+			Entities:  entities,
+		}}
+	}
+
+	if n.LongMessage == LongMessageDocument {
+		return []Sender{&SendDocument{
+			ChatId:      n.ChatId,
+			Document:    strings.NewReader(n.Text),
+			FileName:    "message.txt",
+			ContentType: "text/plain; charset=utf-8",
+			Caption:     truncateText(text, maxCaptionLength),
+		}}
+	}
+
+	senders := []Sender{}
+
+	if n.ParseMode == ParseModeCommonMark {
+		parts, entities := splitEntities(text, entities, maxMessageLength)
+
+		for i, part := range parts {
+			senders = append(senders, &SendMessage{
+				ChatId:   n.ChatId,
+				Text:     part,
+				Entities: entities[i],
+			})
+		}
+
+		return senders
+	}
+
+	// text is split in the same way regardless of fallback in order to
+	// keep track of parts which are already sent
+	for _, part := range splitText(text, n.ParseMode, maxMessageLength) {
+		senders = append(senders, &SendMessage{
+			ChatId:    n.ChatId,
+			Text:      part,
+			ParseMode: n.parseMode(),
+		})
+	}
+
+	return senders
+}
+
+// format converts text to entities if it is written in CommonMark. Entities
+// are dropped if Bot API rejects them.
+func (n *Notification) format(text string) (string, []MessageEntity) {
+	if n.ParseMode != ParseModeCommonMark {
+		return text, nil
+	}
+
+	text, entities := format.CommonMark(text)
+
+	if n.Fallback {
+		return text, nil
+	}
+
+	return text, entities
+}
+
+// parseMode returns parse mode which requests are sent with.
+func (n *Notification) parseMode() string {
+	if n.Fallback || n.ParseMode == ParseModeCommonMark {
+		return ""
+	}
+
+	return n.ParseMode
+}
+
+// group makes request which sends attachments of the same kind either as a
+// single photo or document or as an album.
+func (n *Notification) group(group []Attachment, caption string) Sender {
+	caption, entities := n.format(caption)
+
+	if len(group) == 1 && group[0].Kind == KindPhoto {
+		return &SendPhoto{
+			ChatId:          n.ChatId,
+			Photo:           bytes.NewReader(group[0].Data),
+			FileName:        group[0].FileName,
+			ContentType:     group[0].ContentType,
+			Caption:         caption,
+			ParseMode:       n.parseMode(),
+			CaptionEntities: entities,
+		}
+	} else if len(group) == 1 {
+		return &SendDocument{
+			ChatId:          n.ChatId,
+			Document:        bytes.NewReader(group[0].Data),
+			FileName:        group[0].FileName,
+			ContentType:     group[0].ContentType,
+			Caption:         caption,
+			ParseMode:       n.parseMode(),
+			CaptionEntities: entities,
+		}
+	}
+
+	media := make([]InputMedia, len(group))
+
+	for i, attachment := range group {
+		media[i] = InputMedia{
+			Type:        attachment.Kind,
+			File:        bytes.NewReader(attachment.Data),
+			FileName:    attachment.FileName,
+			ContentType: attachment.ContentType,
+		}
+	}
+
+	media[0].Caption = caption
+	media[0].ParseMode = n.parseMode()
+	media[0].CaptionEntities = entities
+
+	return &SendMediaGroup{ChatId: n.ChatId, Media: media}
+}
+
+const (
+	StateScheduled = "scheduled"
+	StateHeld      = "held"
+	StateQueued    = "queued"
+	StateSent      = "sent"
+	StateFailed    = "failed"
+	StateCancelled = "cancelled"
+)
+
+// Receipt describes delivery status of notification. It is kept for a while
+// after notification is either delivered or buried. Receipt also refers to
+// Telegram message in order to edit it later on behalf of the same token.
+type Receipt struct {
+	Id             string `json:"id"`
+	NotificationId uint64 `json:"-"`
+	Token          string `json:"-"`
+	ChatId         int    `json:"-"`
+	Media          bool   `json:"-"`
+	Label          string `json:"label,omitempty"`
+	Digest         bool   `json:"digest,omitempty"`
+	State          string `json:"state"`
+	MessageId      int    `json:"message_id,omitempty"`
+	Error          string `json:"error,omitempty"`
+	Fallback       bool   `json:"fallback,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	SendAt    *time.Time `json:"send_at,omitempty"`
+}
+
+// IsFinal reports whether notification is either delivered, buried or
+// cancelled.
+func (r *Receipt) IsFinal() bool {
+	return r.State != StateQueued && r.State != StateScheduled &&
+		r.State != StateHeld
+}
+
+// Attempt is an outcome of delivery attempt of notification.
+type Attempt struct {
+	Message *Message
+	Err     error
+
+	// Final is set if notification is either delivered or undeliverable.
+	Final bool
+}
+
+// Outbox delivers notifications which are persistently stored in Storage.
+// Failed deliveries are retried with exponential backoff. Notifications
+// which are rejected by Bot API or which are failed too many times are moved
+// to dead-letter bucket. Notifications to a chat are delivered in order, so a
+// notification which waits for retry holds back the later ones to the same
+// chat for up to MaxBackoff.
+type Outbox struct {
+	Storage    *Storage
+	Dispatcher *Dispatcher
+
+	// MinBackoff is a delay before the first retry. The delay is doubled on
+	// every subsequent retry until it reaches MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts is number of attempts before notification is buried.
+	MaxAttempts int
+
+	// PollInterval is how often outbox is checked for due notifications.
+	PollInterval time.Duration
+
+	// ReceiptTTL is how long receipt is kept after the last update.
+	ReceiptTTL time.Duration
+
+	// IdempotencyTTL is how long idempotency key is kept.
+	IdempotencyTTL time.Duration
+
+	// DeadLetterTTL is how long undeliverable notification is kept along
+	// with its attachments since its last attempt.
+	DeadLetterTTL time.Duration
+
+	mu       sync.Mutex
+	inflight map[uint64]bool
+	waiters  map[uint64][]chan Attempt
+	wake     chan struct{}
+
+	// chats are chats which notifications are being delivered to. Only one
+	// notification is delivered to a chat at once in order to keep order
+	// of notifications.
+	chats map[int]bool
+}
+
+func NewOutbox(storage *Storage, dispatcher *Dispatcher) *Outbox {
+	return &Outbox{
+		Storage:        storage,
+		Dispatcher:     dispatcher,
+		MinBackoff:     5 * time.Second,
+		MaxBackoff:     time.Hour,
+		MaxAttempts:    10,
+		PollInterval:   time.Second,
+		ReceiptTTL:     7 * 24 * time.Hour,
+		IdempotencyTTL: 24 * time.Hour,
+		DeadLetterTTL:  7 * 24 * time.Hour,
+		inflight:       make(map[uint64]bool),
+		chats:          make(map[int]bool),
+		waiters:        make(map[uint64][]chan Attempt),
+		wake:           make(chan struct{}, 1),
+	}
+}
+
+// Push stores notification in outbox and watches for the first delivery
+// attempt. If notification with the same idempotency key is already accepted
+// then ErrRepeatedRequest is returned and receipt of that notification is
+// assigned.
+func (o *Outbox) Push(ctx context.Context, n *Notification) (<-chan Attempt, func(), error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n.CreatedAt = time.Now()
+	n.NextAttempt = n.CreatedAt
+
+	if err := o.Storage.PutNotification(ctx, n); err != nil {
+		return nil, nil, err
+	}
+
+	ch, stop := o.watch(n.Id)
+	o.Wake()
+
+	return ch, stop, nil
+}
+
+// Wake makes outbox look for due notifications without waiting for the next
+// poll (e.g. when scheduled notifications are moved to outbox).
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Watch returns channel which receives an outcome of the next delivery
+// attempt of notification and a function which stops watching.
+func (o *Outbox) Watch(id uint64) (<-chan Attempt, func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.watch(id)
+}
+
+func (o *Outbox) watch(id uint64) (<-chan Attempt, func()) {
+	ch := make(chan Attempt, 1)
+	o.waiters[id] = append(o.waiters[id], ch)
+
+	stop := func() {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+
+		for i, waiter := range o.waiters[id] {
+			if waiter == ch {
+				o.waiters[id] = append(o.waiters[id][:i], o.waiters[id][i+1:]...)
+				break
+			}
+		}
+
+		if len(o.waiters[id]) == 0 {
+			delete(o.waiters, id)
+		}
+	}
+
+	return ch, stop
+}
+
+// Await waits until notification is either delivered or buried or until
+// timeout expires or context is cancelled. If final is not set then it waits
+// for the next delivery attempt only. It returns nil on timeout.
+func (o *Outbox) Await(ctx context.Context, id uint64, ch <-chan Attempt, stop func(), timeout time.Duration, final bool) *Attempt {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case attempt := <-ch:
+			stop()
+
+			if attempt.Final || !final {
+				return &attempt
+			}
+
+			// watch for the next attempt unless notification has gone
+			ch, stop = o.Watch(id)
+
+			if n, err := o.Storage.SelectNotification(ctx, id); err != nil || n == nil {
+				stop()
+				return &attempt
+			}
+		case <-timer.C:
+			stop()
+			return nil
+		case <-ctx.Done():
+			stop()
+			return nil
+		}
+	}
+}
+
+// Run delivers due notifications from outbox. It returns when context is
+// cancelled. Notifications which are not delivered yet stay in outbox.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.PollInterval)
+	defer ticker.Stop()
+
+	pruned := time.Time{}
+
+	for ctx.Err() == nil {
+		// forget receipts of finished deliveries and expired idempotency
+		// keys from time to time
+		if now := time.Now(); now.Sub(pruned) > time.Hour {
+			if err := o.Storage.PruneReceipts(ctx, now.Add(-o.ReceiptTTL)); err != nil {
+				log.Println("error:", err)
+			}
+
+			if err := o.Storage.PruneIdempotencyKeys(ctx, now.Add(-o.IdempotencyTTL)); err != nil {
+				log.Println("error:", err)
+			}
+
+			if err := o.Storage.PruneDeadNotifications(ctx, now.Add(-o.DeadLetterTTL)); err != nil {
+				log.Println("error:", err)
+			}
+
+			pruned = now
+		}
+
+		entries, err := o.Storage.SelectOutbox(ctx)
+
+		if err != nil {
+			log.Println("error:", err)
+		}
+
+		// notifications are ordered by identifier, so only the earliest
+		// pending one is delivered to every chat; chat waits for it even if
+		// it is not due yet
+		now := time.Now()
+		pending := map[int]bool{}
+
+		for _, entry := range entries {
+			if pending[entry.ChatId] {
+				continue
+			}
+
+			pending[entry.ChatId] = true
+
+			if entry.NextAttempt.After(now) {
+				continue
+			}
+
+			o.mu.Lock()
+			busy := o.inflight[entry.Id] || o.chats[entry.ChatId]
+
+			if !busy {
+				o.inflight[entry.Id] = true
+				o.chats[entry.ChatId] = true
+			}
+
+			o.mu.Unlock()
+
+			if !busy {
+				go o.deliver(ctx, entry.Id, entry.ChatId)
+			}
+		}
+
+		select {
+		case <-o.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// deliver makes an attempt to deliver notification and then either removes
+// it from outbox, schedules the next attempt or buries it. Notification is
+// reloaded since it could be delivered while outbox was scanned. Outcome of
+// attempt is stored even if context is cancelled during attempt.
+func (o *Outbox) deliver(ctx context.Context, id uint64, chat int) {
+	n, err := o.Storage.SelectNotification(ctx, id)
+
+	if err != nil || n == nil || n.NextAttempt.After(time.Now()) {
+		if err != nil {
+			log.Println("error:", err)
+		}
+
+		o.mu.Lock()
+		o.release(id, chat)
+		o.mu.Unlock()
+		return
+	}
+
+	// send the rest of requests which are not sent yet
+	var msg *Message
+	senders := n.Senders()
+
+	for n.Delivered < len(senders) {
+		msg, err = o.Dispatcher.Send(ctx, senders[n.Delivered], n.priority())
+
+		// resend the rest without formatting if markup is malformed
+		if isParseError(err) && !n.Fallback {
+			log.Println("send notification", n.Id, "as plain text:", err)
+			n.Fallback = true
+			senders = n.Senders()
+			continue
+		}
+
+		if err != nil {
+			break
+		} else if n.Delivered == 0 {
+			n.MessageId = msg.MessageId
+		}
+
+		n.Delivered += 1
+	}
+
+	// server is stopping, so keep progress and try again after restart
+	if err != nil && ctx.Err() != nil {
+		if err := o.Storage.PutNotification(context.WithoutCancel(ctx), n); err != nil {
+			log.Println("error:", err)
+		}
+
+		return
+	}
+
+	attempt := Attempt{Message: msg, Err: err, Final: true}
+	n.Attempts += 1
+	ctx = context.WithoutCancel(ctx)
+
+	if err == nil {
+		err = o.Storage.CompleteNotification(ctx, n)
+	} else if n.LastError = err.Error(); isPermanent(err) ||
+		n.Attempts >= o.MaxAttempts {
+		log.Println("bury notification", n.Id, "after", n.Attempts,
+			"attempts:", n.LastError)
+		err = o.Storage.BuryNotification(ctx, n)
+	} else {
+		attempt.Final = false
+		n.NextAttempt = time.Now().Add(o.backoff(n.Attempts, attempt.Err))
+		err = o.Storage.PutNotification(ctx, n)
+	}
+
+	if err != nil {
+		log.Println("error:", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, ch := range o.waiters[n.Id] {
+		ch <- attempt
+	}
+
+	delete(o.waiters, n.Id)
+	o.release(n.Id, chat)
+}
+
+// release allows to deliver the next notification to chat. It is called with
+// lock held.
+func (o *Outbox) release(id uint64, chat int) {
+	delete(o.inflight, id)
+	delete(o.chats, chat)
+	o.Wake()
+}
+
+// backoff returns delay before the next attempt. The delay is never shorter
+// than Bot API asks.
+func (o *Outbox) backoff(attempts int, err error) time.Duration {
+	delay := o.MinBackoff
+
+	for i := 1; i < attempts && delay < o.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > o.MaxBackoff {
+		delay = o.MaxBackoff
+	}
+
+	var apiErr *APIError
+
+	if errors.As(err, &apiErr) {
+		if retryAfter := time.Duration(apiErr.RetryAfter) * time.Second; retryAfter > delay {
+			delay = retryAfter
+		}
+	}
+
+	return delay
+}
+
+// isPermanent reports whether Bot API rejects request and it is useless to
+// repeat it.
+func isPermanent(err error) bool {
+	var apiErr *APIError
+
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	return apiErr.Code == http.StatusBadRequest ||
+		apiErr.Code == http.StatusForbidden
+}
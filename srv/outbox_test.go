@@ -0,0 +1,195 @@
+package srv
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNotificationSenders(t *testing.T) {
+	n := &Notification{ChatId: 1, Caption: "Evaluation"}
+
+	for i := 0; i != 12; i++ {
+		n.Attachments = append(n.Attachments, Attachment{Kind: KindPhoto})
+	}
+
+	n.Attachments = append(n.Attachments, Attachment{Kind: KindDocument})
+
+	// photos are split into albums of 10 and 2 items
+	senders := n.Senders()
+
+	if len(senders) != 3 {
+		t.Fatal("wrong number of requests: ", len(senders))
+	}
+
+	if group, ok := senders[0].(*SendMediaGroup); !ok || len(group.Media) != 10 {
+		t.Error("wrong first album: ", senders[0])
+	} else if group.Media[0].Caption != n.Caption {
+		t.Error("wrong caption: ", group.Media[0].Caption)
+	}
+
+	if group, ok := senders[1].(*SendMediaGroup); !ok || len(group.Media) != 2 {
+		t.Error("wrong second album: ", senders[1])
+	} else if group.Media[0].Caption != "" {
+		t.Error("caption is repeated: ", group.Media[0].Caption)
+	}
+
+	if _, ok := senders[2].(*SendDocument); !ok {
+		t.Error("wrong document: ", senders[2])
+	}
+}
+
+func TestOutboxParseModeFallback(t *testing.T) {
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		msg := &SendMessage{}
+		json.NewDecoder(req.Body).Decode(msg)
+
+		if msg.ParseMode != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"ok": false, "error_code": 400, "description": ` +
+				`"Bad Request: can't parse entities: unclosed entity"}`))
+		} else {
+			w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "boltdb-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer os.Remove(TokenKeyPath(file.Name()))
+
+	storage, err := NewStorage(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dispatcher := NewDispatcher(New("42:token", WithEndpoint(server.URL)))
+	dispatcher.ChatInterval = 10 * time.Millisecond
+	outbox := NewOutbox(storage, dispatcher)
+
+	go dispatcher.Run(ctx)
+	go outbox.Run(ctx)
+
+	n := &Notification{ChatId: 1, Text: "model_v2_final", ParseMode: "Markdown"}
+	ch, stop, err := outbox.Push(ctx, n)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempt := outbox.Await(ctx, n.Id, ch, stop, time.Second, true); attempt == nil {
+		t.Fatal("notification is not delivered in time")
+	} else if attempt.Err != nil {
+		t.Fatal(attempt.Err)
+	}
+
+	if receipt, err := storage.SelectReceipt(ctx, n.ReceiptId); err != nil {
+		t.Fatal(err)
+	} else if receipt.State != StateSent || !receipt.Fallback {
+		t.Error("fallback is not recorded: ", receipt)
+	}
+}
+
+func TestOutboxOrderAfterFailure(t *testing.T) {
+	texts := make(chan string, 10)
+	failed := false
+
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		msg := &SendMessage{}
+		json.NewDecoder(req.Body).Decode(msg)
+		texts <- msg.Text
+
+		// the first attempt to send the first notification fails
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(`{"ok": false, "error_code": 502, ` +
+				`"description": "Bad Gateway"}`))
+		} else {
+			w.Write([]byte(`{"ok": true, "result": {"message_id": 1}}`))
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	defer server.Close()
+
+	file, err := ioutil.TempFile("", "boltdb-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer os.Remove(TokenKeyPath(file.Name()))
+
+	storage, err := NewStorage(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dispatcher := NewDispatcher(New("42:token", WithEndpoint(server.URL)))
+	dispatcher.ChatInterval = 10 * time.Millisecond
+	outbox := NewOutbox(storage, dispatcher)
+	outbox.MinBackoff = 200 * time.Millisecond
+	outbox.PollInterval = 10 * time.Millisecond
+
+	go dispatcher.Run(ctx)
+
+	// both notifications are in outbox before it starts
+	first := &Notification{ChatId: 1, Text: "1"}
+	second := &Notification{ChatId: 1, Text: "2"}
+	ch, stop, err := outbox.Push(ctx, first)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop()
+
+	if ch, stop, err = outbox.Push(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+
+	go outbox.Run(ctx)
+
+	if attempt := outbox.Await(ctx, second.Id, ch, stop, 5*time.Second, true); attempt == nil {
+		t.Fatal("notification is not delivered in time")
+	} else if attempt.Err != nil {
+		t.Fatal(attempt.Err)
+	}
+
+	// second notification waits for retry of the first one
+	order := []string{}
+
+	for len(texts) > 0 {
+		order = append(order, <-texts)
+	}
+
+	if len(order) != 3 || order[0] != "1" || order[1] != "1" || order[2] != "2" {
+		t.Error("wrong order of requests: ", order)
+	}
+}
@@ -0,0 +1,205 @@
+package srv
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KindText is a kind of content of notification without attachments.
+const KindText = "text"
+
+// TokenPolicy restricts usage of token. Zero policy allows everything.
+type TokenPolicy struct {
+	// Kinds are kinds of content which token could send (text, photo or
+	// document). Any content is allowed if it is empty.
+	Kinds []string
+
+	// ExpiresAt is a moment after which token is not valid. Token never
+	// expires if it is zero.
+	ExpiresAt time.Time
+
+	// MaxUses is number of notifications which token could send. It is
+	// unlimited if it is zero.
+	MaxUses int
+
+	// Networks are CIDR blocks which requests with token could come from.
+	// Any address is allowed if it is empty.
+	Networks []string
+}
+
+// IsExpired reports whether token is expired at the given moment.
+func (p *TokenPolicy) IsExpired(now time.Time) bool {
+	return !p.ExpiresAt.IsZero() && !now.Before(p.ExpiresAt)
+}
+
+// AllowsAddr reports whether requests could come from the address.
+func (p *TokenPolicy) AllowsAddr(ip net.IP) bool {
+	return len(p.Networks) == 0 || ip != nil && containsIP(p.Networks, ip)
+}
+
+// AllowsContent reports whether token could send notification.
+func (p *TokenPolicy) AllowsContent(n *Notification) bool {
+	if len(p.Kinds) == 0 {
+		return true
+	}
+
+	kinds := []string{KindText}
+
+	if len(n.Attachments) != 0 {
+		kinds = kinds[:0]
+	}
+
+	for _, attachment := range n.Attachments {
+		kinds = append(kinds, attachment.Kind)
+	}
+
+	for _, kind := range kinds {
+		allowed := false
+
+		for _, allowedKind := range p.Kinds {
+			allowed = allowed || kind == allowedKind
+		}
+
+		if !allowed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Describe describes restrictions of policy to user. Uses is number of
+// requests which token has authorized so far.
+func (p *TokenPolicy) Describe(uses int) string {
+	parts := []string{}
+
+	if len(p.Kinds) != 0 {
+		parts = append(parts, strings.Join(p.Kinds, ", ")+" only")
+	}
+
+	if !p.ExpiresAt.IsZero() {
+		parts = append(parts, "expires "+p.ExpiresAt.UTC().Format("2006-01-02 15:04")+" UTC")
+	}
+
+	if p.MaxUses != 0 {
+		parts = append(parts, strconv.Itoa(uses)+" of "+strconv.Itoa(p.MaxUses)+" uses")
+	}
+
+	if len(p.Networks) != 0 {
+		parts = append(parts, "from "+strings.Join(p.Networks, ", "))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// parsePolicy parses options of /new command (e.g. `kinds=text expires=7d
+// uses=1 from=10.0.0.0/8`). Expiry is either in days or in Go notation.
+func parsePolicy(args []string, now time.Time) (TokenPolicy, bool) {
+	policy := TokenPolicy{}
+
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+
+		if len(kv) != 2 || len(kv[1]) == 0 {
+			return policy, false
+		}
+
+		values := strings.Split(kv[1], ",")
+
+		switch strings.ToLower(kv[0]) {
+		case "kinds":
+			for _, kind := range values {
+				if kind != KindText && kind != KindPhoto && kind != KindDocument {
+					return policy, false
+				}
+			}
+
+			policy.Kinds = values
+		case "expires":
+			ttl, ok := parseTTL(kv[1])
+
+			if !ok || ttl <= 0 {
+				return policy, false
+			}
+
+			policy.ExpiresAt = now.Add(ttl)
+		case "uses":
+			uses, err := strconv.Atoi(kv[1])
+
+			if err != nil || uses <= 0 {
+				return policy, false
+			}
+
+			policy.MaxUses = uses
+		case "from":
+			for _, network := range values {
+				if _, _, err := net.ParseCIDR(network); err != nil {
+					return policy, false
+				}
+			}
+
+			policy.Networks = values
+		default:
+			return policy, false
+		}
+	}
+
+	return policy, true
+}
+
+// parseTTL parses lifetime of token either in days (e.g. `7d`) or in Go
+// notation (e.g. `12h`).
+func parseTTL(value string) (time.Duration, bool) {
+	if days := strings.TrimSuffix(value, "d"); days != value {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * 24 * time.Hour, err == nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	return ttl, err == nil
+}
+
+// containsIP reports whether any of CIDR blocks contains the address.
+func containsIP(networks []string, ip net.IP) bool {
+	for _, network := range networks {
+		if _, ipnet, err := net.ParseCIDR(network); err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns address of client. Address in `X-Forwarded-For` header
+// is used only if request comes from trusted proxy.
+func (t *TelePyth) clientIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil || !containsIP(t.TrustedProxies, ip) {
+		return ip
+	}
+
+	// the rightmost address which is not a proxy is a client
+	forwarded := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := net.ParseIP(strings.TrimSpace(forwarded[i]))
+
+		if addr == nil {
+			break
+		} else if ip = addr; !containsIP(t.TrustedProxies, addr) {
+			break
+		}
+	}
+
+	return ip
+}
@@ -0,0 +1,163 @@
+package srv
+
+import (
+	"strings"
+	"time"
+
+	// time zones of users are known even if system has no tz database
+	_ "time/tzdata"
+)
+
+// Location returns time zone of user. It is UTC unless user sets another one.
+func (p *Preferences) Location() *time.Location {
+	if len(p.Timezone) == 0 {
+		return time.UTC
+	} else if loc, err := time.LoadLocation(p.Timezone); err == nil {
+		return loc
+	}
+
+	return time.UTC
+}
+
+// zoneName returns name of time zone of user.
+func (p *Preferences) zoneName() string {
+	return p.Location().String()
+}
+
+// IsQuiet reports whether the moment is within quiet hours of user.
+func (p *Preferences) IsQuiet(moment time.Time) bool {
+	if !p.Quiet || p.QuietFrom == p.QuietTo {
+		return false
+	}
+
+	local := moment.In(p.Location())
+	offset := local.Sub(atClock(local, 0))
+
+	if p.QuietFrom < p.QuietTo {
+		return p.QuietFrom <= offset && offset < p.QuietTo
+	}
+
+	return offset >= p.QuietFrom || offset < p.QuietTo
+}
+
+// QuietEnd returns the moment when quiet hours which the moment is within
+// are over.
+func (p *Preferences) QuietEnd(moment time.Time) time.Time {
+	end := atClock(moment.In(p.Location()), p.QuietTo)
+
+	if !end.After(moment) {
+		end = atClock(end.AddDate(0, 0, 1), p.QuietTo)
+	}
+
+	return end
+}
+
+// quiet applies quiet hours to notification which is accepted at the given
+// moment. Notification which is due within quiet hours is either sent
+// silently or is postponed until they are over.
+func (p *Preferences) quiet(n *Notification, moment time.Time) {
+	if n.SendAt.After(moment) {
+		moment = n.SendAt
+	}
+
+	if !p.IsQuiet(moment) {
+		return
+	} else if p.QuietHold {
+		n.SendAt = p.QuietEnd(moment)
+	} else {
+		n.DisableNotification = true
+	}
+}
+
+// DescribeQuiet describes quiet hours to user.
+func (p *Preferences) DescribeQuiet() string {
+	if !p.Quiet {
+		return "Quiet hours are off. Time zone is " + p.zoneName() + "."
+	}
+
+	text := "Quiet hours are from " + formatClock(p.QuietFrom) + " to " +
+		formatClock(p.QuietTo) + " " + p.zoneName() + "."
+
+	if p.QuietHold {
+		return text + " Notifications are held until quiet hours are over."
+	}
+
+	return text + " Notifications are sent silently."
+}
+
+// parseQuiet parses arguments of /quiet command. They are either `off` or
+// range of quiet hours (e.g. `23:00-08:00`) which is optionally followed by
+// time zone (e.g. `Europe/Moscow`) and by either `silent` or `hold`.
+func parseQuiet(args []string, p *Preferences) bool {
+	if len(args) == 0 {
+		return false
+	} else if strings.ToLower(args[0]) == "off" {
+		p.Quiet = false
+		return len(args) == 1
+	}
+
+	bounds := strings.SplitN(args[0], "-", 2)
+
+	if len(bounds) != 2 {
+		return false
+	}
+
+	from, ok := parseClock(bounds[0])
+
+	if !ok {
+		return false
+	}
+
+	to, ok := parseClock(bounds[1])
+
+	if !ok || from == to {
+		return false
+	}
+
+	p.Quiet = true
+	p.QuietFrom = from
+	p.QuietTo = to
+	p.QuietHold = false
+
+	for _, arg := range args[1:] {
+		switch strings.ToLower(arg) {
+		case "silent":
+			p.QuietHold = false
+		case "hold":
+			p.QuietHold = true
+		default:
+			if _, err := time.LoadLocation(arg); err != nil || arg == "Local" {
+				return false
+			}
+
+			p.Timezone = arg
+		}
+	}
+
+	return true
+}
+
+// parseClock parses time of day (e.g. `09:00`) as offset from midnight.
+func parseClock(value string) (time.Duration, bool) {
+	at, err := time.Parse("15:04", value)
+
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Duration(at.Hour())*time.Hour +
+		time.Duration(at.Minute())*time.Minute, true
+}
+
+func formatClock(offset time.Duration) string {
+	return time.Time{}.Add(offset).Format("15:04")
+}
+
+// atClock returns the moment of the same day which is the given time of
+// day.
+func atClock(day time.Time, offset time.Duration) time.Time {
+	hours := int(offset / time.Hour)
+	minutes := int(offset % time.Hour / time.Minute)
+	return time.Date(day.Year(), day.Month(), day.Day(), hours, minutes, 0, 0,
+		day.Location())
+}
@@ -0,0 +1,49 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPreferencesQuiet(t *testing.T) {
+	prefs := &Preferences{}
+	args := strings.Fields("23:00-08:00 Europe/Moscow hold")
+
+	if !parseQuiet(args, prefs) {
+		t.Fatal("quiet hours are not parsed")
+	} else if !prefs.QuietHold || prefs.Timezone != "Europe/Moscow" {
+		t.Fatal("wrong quiet hours: ", prefs)
+	}
+
+	// 21:30 UTC is 00:30 in Moscow
+	night := time.Date(2024, 5, 1, 21, 30, 0, 0, time.UTC)
+	morning := time.Date(2024, 5, 2, 5, 0, 0, 0, time.UTC)
+
+	if !prefs.IsQuiet(night) {
+		t.Error("night is not quiet")
+	} else if prefs.IsQuiet(morning) {
+		t.Error("morning is quiet")
+	} else if end := prefs.QuietEnd(night); !end.Equal(morning) {
+		t.Error("wrong end of quiet hours: ", end)
+	}
+
+	n := &Notification{}
+	prefs.quiet(n, night)
+
+	if !n.SendAt.Equal(morning) {
+		t.Error("notification is not postponed: ", n.SendAt)
+	}
+
+	n = &Notification{}
+	prefs.QuietHold = false
+	prefs.quiet(n, night)
+
+	if !n.DisableNotification || !n.SendAt.IsZero() {
+		t.Error("notification is not silent: ", n)
+	}
+
+	if parseQuiet(strings.Fields("23:00-08:00 Mars/Olympus"), prefs) {
+		t.Error("unknown time zone is accepted")
+	}
+}
@@ -0,0 +1,24 @@
+package srv
+
+import (
+	"strings"
+)
+
+// RedactToken hides token in order to print it in logs. A few leading
+// characters are kept to tell tokens apart.
+func RedactToken(token string) string {
+	if len(token) <= 8 {
+		return "****"
+	}
+
+	return token[:4] + "****"
+}
+
+// redact replaces token in text with its redacted form.
+func redact(text, token string) string {
+	if len(token) == 0 {
+		return text
+	}
+
+	return strings.ReplaceAll(text, token, RedactToken(token))
+}
@@ -0,0 +1,141 @@
+package srv
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultRotationGrace is how long rotated token stays valid by default.
+const defaultRotationGrace = 24 * time.Hour
+
+// maxRotationGrace is the longest grace period of rotated token.
+const maxRotationGrace = 30 * 24 * time.Hour
+
+// RotateResponse is a body of response to rotation request.
+type RotateResponse struct {
+	Token      string    `json:"token"`
+	Label      string    `json:"label"`
+	GraceUntil time.Time `json:"grace_until"`
+}
+
+// rotationGrace returns grace period of rotated token. Period is either in
+// days or in Go notation (e.g. `7d` or `12h`). Default period is used if it
+// is empty.
+func (t *TelePyth) rotationGrace(value string) (time.Duration, bool) {
+	if len(value) == 0 {
+		if t.RotationGrace > 0 {
+			return t.RotationGrace, true
+		}
+
+		return defaultRotationGrace, true
+	}
+
+	grace, ok := parseTTL(value)
+	return grace, ok && grace >= 0 && grace <= maxRotationGrace
+}
+
+// deprecateToken warns client that token is rotated and tells when it stops
+// working.
+func deprecateToken(w http.ResponseWriter, ut *UserToken) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Sunset", ut.GraceUntil.UTC().Format(http.TimeFormat))
+	w.Header().Add("Warning", `299 - "token is rotated and is valid until `+
+		ut.GraceUntil.UTC().Format(time.RFC3339)+`"`)
+}
+
+// HandleRotateCommand issues replacement of token with label or of the
+// latest token. Old token stays valid for grace period which is optionally
+// passed after label.
+func (t *TelePyth) HandleRotateCommand(ctx context.Context, user *User, args []string) {
+	msg := &SendMessage{ChatId: user.Id}
+	label, period := "", ""
+
+	if len(args) > 0 {
+		label = args[0]
+	}
+
+	if len(args) > 1 {
+		period = args[1]
+	}
+
+	grace, ok := t.rotationGrace(period)
+	until := time.Now().Add(grace)
+
+	if !ok || len(args) > 2 || len(label) != 0 && !isLabel(label) {
+		msg.Text = "Usage: /rotate [label] [grace], e.g. /rotate laptop 48h. " +
+			"Grace is at most 30d."
+	} else if token, rotated, err := t.Storage.RotateTokenBy(ctx, user, label, until); err == ErrUnknownLabel {
+		msg.Text = "There is no valid token " + label + ". See /tokens."
+	} else if err != nil {
+		log.Println("error:", err)
+		return
+	} else {
+		msg.Text = "Your new access token `" + rotated + "` is `" + token +
+			"`. Old one works until " + until.UTC().Format("2006-01-02 15:04") +
+			" UTC."
+		msg.ParseMode = "Markdown"
+	}
+
+	if _, err := t.Dispatcher.Send(ctx, msg, PriorityInteractive); err != nil {
+		log.Println("error: ", err)
+	}
+}
+
+// HandleRotateRequest issues replacement of token which request is
+// authorized with. Token is passed in header only. Query parameter `grace`
+// sets how long the old token stays valid.
+//
+//	POST /api/tokens/rotate?grace=48h
+func (t *TelePyth) HandleRotateRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, ok := headerToken(req)
+
+	if !ok {
+		writeJSONError(w, errorStatus(http.StatusUnauthorized))
+		return
+	} else if _, err := t.findUser(w, req, token); err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	grace, ok := t.rotationGrace(req.URL.Query().Get("grace"))
+
+	if !ok {
+		writeJSONError(w, &httpError{http.StatusBadRequest, "wrong grace period"})
+		return
+	}
+
+	until := time.Now().Add(grace)
+	replacement, err := t.Storage.RotateToken(req.Context(), token, until)
+
+	if err == ErrTokenRotated {
+		writeJSONError(w, &httpError{http.StatusConflict, "token is already rotated"})
+		return
+	} else if err != nil {
+		log.Println("error:", err)
+		writeJSONError(w, errorStatus(http.StatusInternalServerError))
+		return
+	}
+
+	ut, err := t.Storage.SelectUserToken(req.Context(), replacement)
+
+	if err != nil {
+		log.Println("error:", err)
+		writeJSONError(w, errorStatus(http.StatusInternalServerError))
+		return
+	}
+
+	log.Println("token", RedactToken(token), "is rotated until", until)
+
+	writeJSON(w, http.StatusOK, &RotateResponse{
+		Token:      replacement,
+		Label:      ut.Label,
+		GraceUntil: until,
+	})
+}
@@ -0,0 +1,176 @@
+package srv
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Scheduler keeps notifications which should be sent later and moves them to
+// outbox when they are due. Scheduled notifications are stored persistently,
+// so they survive restart of server, and overdue ones are sent on start up.
+// Scheduler also sends digests of notifications which are held for users who
+// prefer summaries.
+type Scheduler struct {
+	Storage *Storage
+	Outbox  *Outbox
+
+	// PollInterval is how often scheduled notifications are checked.
+	PollInterval time.Duration
+}
+
+func NewScheduler(storage *Storage, outbox *Outbox) *Scheduler {
+	return &Scheduler{
+		Storage:      storage,
+		Outbox:       outbox,
+		PollInterval: time.Second,
+	}
+}
+
+// Schedule stores notification until it is due. If notification with the
+// same idempotency key is already accepted then ErrRepeatedRequest is
+// returned and receipt of that notification is assigned.
+func (s *Scheduler) Schedule(ctx context.Context, n *Notification) error {
+	n.CreatedAt = time.Now()
+	return s.Storage.ScheduleNotification(ctx, n)
+}
+
+// Hold keeps notification until digest of user is sent. If notification with
+// the same idempotency key is already accepted then ErrRepeatedRequest is
+// returned.
+func (s *Scheduler) Hold(ctx context.Context, n *Notification) error {
+	n.CreatedAt = time.Now()
+	return s.Storage.HoldNotification(ctx, n)
+}
+
+// Run moves due notifications and digests to outbox. It returns when context is
+// cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		notifications, err := s.Storage.SelectDueScheduled(ctx, time.Now())
+
+		if err != nil {
+			log.Println("error:", err)
+		}
+
+		released := false
+
+		for _, n := range notifications {
+			err := s.Storage.ReleaseScheduled(ctx, n)
+
+			if errors.Is(err, ErrUnknownScheduled) {
+				// notification is cancelled meanwhile
+			} else if err != nil {
+				log.Println("error:", err)
+			} else {
+				released = true
+			}
+		}
+
+		if s.digest(ctx) || released {
+			s.Outbox.Wake()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// digest replaces held notifications with summaries if digests are due. It
+// reports whether any summary is put into outbox. Digest is due once the
+// earliest held notification has waited long enough, so it is sent at once
+// if user turns digest off. Within quiet hours, digest is either sent
+// silently or postponed.
+func (s *Scheduler) digest(ctx context.Context) bool {
+	digests, err := s.Storage.SelectDigests(ctx)
+
+	if err != nil {
+		log.Println("error:", err)
+		return false
+	}
+
+	released := false
+
+	for chat, held := range digests {
+		prefs, err := s.Storage.SelectPreferences(ctx, &User{Id: chat})
+
+		if err != nil {
+			log.Println("error:", err)
+			continue
+		} else if prefs.NextDigest(held[0].CreatedAt).After(time.Now()) {
+			continue
+		} else if prefs.IsQuiet(time.Now()) && prefs.QuietHold && prefs.IsDigest() {
+			continue
+		}
+
+		summaries := digestSummaries(held)
+
+		// digest is silent within quiet hours
+		for _, summary := range summaries {
+			summary.DisableNotification = summary.DisableNotification ||
+				prefs.IsQuiet(time.Now())
+		}
+
+		if err := s.Storage.ReleaseDigest(ctx, held, summaries); err != nil {
+			log.Println("error:", err)
+		} else {
+			log.Println("send digest of", len(held), "notifications to user", chat)
+			released = true
+		}
+	}
+
+	return released
+}
+
+// HandleScheduledRequest lets user see notifications which are scheduled with
+// token and cancel them. Token is passed in header only.
+//
+//	GET    /api/scheduled/            list pending notifications
+//	DELETE /api/scheduled/<receipt>   cancel notification
+func (t *TelePyth) HandleScheduledRequest(w http.ResponseWriter, req *http.Request) {
+	token, ok := headerToken(req)
+
+	if !ok {
+		writeError(w, errorStatus(http.StatusUnauthorized))
+		return
+	} else if _, err := t.findUser(w, req, token); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := strings.TrimPrefix(req.URL.Path, "/api/scheduled/")
+
+	switch {
+	case len(id) == 0 && req.Method == "GET":
+		notifications, err := t.Storage.SelectScheduled(req.Context(), t.Storage.HashToken(token))
+
+		if err != nil {
+			log.Println("error:", err)
+			writeError(w, errorStatus(http.StatusInternalServerError))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, notifications)
+	case len(id) != 0 && req.Method == "DELETE":
+		err := t.Storage.CancelScheduled(req.Context(), t.Storage.HashToken(token), id)
+
+		if errors.Is(err, ErrUnknownScheduled) {
+			writeError(w, errorStatus(http.StatusNotFound))
+		} else if err != nil {
+			log.Println("error:", err)
+			writeError(w, errorStatus(http.StatusInternalServerError))
+		} else if err := t.writeReceipt(w, req, id); err != nil {
+			writeError(w, err)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,249 @@
+package srv
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/daskol/telepyth/srv/format"
+)
+
+// maxMessageLength is the longest text of message in UTF-16 code units which
+// Bot API accepts.
+const maxMessageLength = 4096
+
+// maxCaptionLength is the longest caption of photo or document.
+const maxCaptionLength = 1024
+
+const (
+	// LongMessageSplit sends long text as several consecutive messages.
+	LongMessageSplit = "split"
+
+	// LongMessageDocument sends long text as a text file with a preview of
+	// the text in caption.
+	LongMessageDocument = "document"
+)
+
+// IsLongMessagePolicy reports whether policy is a known way to deliver long
+// messages.
+func IsLongMessagePolicy(policy string) bool {
+	return policy == LongMessageSplit || policy == LongMessageDocument
+}
+
+// truncateText cuts text to the given length in UTF-16 code units and marks
+// the cut with ellipsis.
+func truncateText(text string, limit int) string {
+	if format.TextLength(text) <= limit {
+		return text
+	}
+
+	length := 0
+
+	for i, r := range text {
+		if length+format.RuneLength(r) > limit-1 {
+			return strings.TrimRightFunc(text[:i], unicode.IsSpace) + "…"
+		}
+
+		length += format.RuneLength(r)
+	}
+
+	return text
+}
+
+// splitText splits text into parts which fit the limit. Text is split at
+// line boundaries where possible. Parts do not break entities of the parse
+// mode: Markdown code block which spans several parts is closed at the end of
+// a part and is reopened at the beginning of the next one, and inline
+// entities and HTML tags are split only if there is no other way.
+func splitText(text, parseMode string, limit int) []string {
+	parts := []string{}
+	fence := ""
+
+	for len(text) != 0 {
+		prefix := ""
+
+		if len(fence) != 0 {
+			prefix = fence + "\n"
+		}
+
+		if format.TextLength(prefix)+format.TextLength(text) <= limit {
+			parts = append(parts, prefix+text)
+			break
+		}
+
+		// reserve room for prefix and for closing code fence
+		budget := limit - format.TextLength(prefix) - len("\n```")
+		cut, open := findCut(text, parseMode, budget, fence)
+		part := prefix + strings.TrimRight(text[:cut], "\n")
+
+		if len(open) != 0 {
+			part += "\n```"
+		}
+
+		parts = append(parts, part)
+		text = strings.TrimLeft(text[cut:], "\n")
+		fence = open
+	}
+
+	return parts
+}
+
+// entityMarkers are characters which open and close inline entities in
+// Markdown flavours.
+var entityMarkers = map[string]string{
+	"Markdown":   "*_",
+	"MarkdownV2": "*_~",
+}
+
+// findCut finds where to cut text so that the head is not longer than budget.
+// It returns byte offset of the cut and opening line of code block which is
+// not closed before the cut. The latest line break where no entity is open is
+// preferred, then whitespace, then any line break or whitespace.
+func findCut(text, parseMode string, budget int, fence string) (int, string) {
+	var line, space, anyLine, anySpace, hard int
+	var lineFence, spaceFence, anyLineFence, anySpaceFence, hardFence string
+	var code, escaped, skip, tag bool
+
+	markers, markdown := entityMarkers[parseMode]
+	open := map[rune]bool{}
+	depth := 0
+	length := 0
+	lineStart := true
+
+	for i, r := range text {
+		if length += format.RuneLength(r); length > budget {
+			break
+		}
+
+		end := i + utf8.RuneLen(r)
+
+		// code fence opens or closes code block and the rest of its line
+		// is language name
+		if markdown && lineStart && strings.HasPrefix(text[i:], "```") {
+			if len(fence) == 0 {
+				fence = strings.TrimRight(strings.SplitN(text[i:], "\n", 2)[0], " \r")
+			} else {
+				fence = ""
+			}
+
+			skip = true
+		}
+
+		lineStart = r == '\n'
+
+		switch {
+		case markdown && len(fence) == 0 && !skip && !escaped:
+			if r == '`' {
+				code = !code
+			} else if !code && strings.ContainsRune(markers, r) {
+				open[r] = !open[r]
+			}
+		case parseMode == "HTML" && r == '<':
+			tag = true
+
+			if strings.HasPrefix(text[i:], "</") {
+				depth -= 1
+			} else {
+				depth += 1
+			}
+		case parseMode == "HTML" && r == '>':
+			tag = false
+		}
+
+		escaped = markdown && r == '\\' && !escaped && !code
+
+		if r == '\n' {
+			skip = false
+		}
+
+		balanced := !code && !tag && depth <= 0
+
+		for _, opened := range open {
+			balanced = balanced && !opened
+		}
+
+		if r == '\n' {
+			anyLine, anyLineFence = end, fence
+
+			if balanced {
+				line, lineFence = end, fence
+			}
+		} else if unicode.IsSpace(r) {
+			if !tag {
+				anySpace, anySpaceFence = end, fence
+			}
+
+			if balanced && len(fence) == 0 {
+				space, spaceFence = end, fence
+			}
+		}
+
+		hard, hardFence = end, fence
+	}
+
+	switch {
+	case line != 0:
+		return line, lineFence
+	case space != 0:
+		return space, spaceFence
+	case anyLine != 0:
+		return anyLine, anyLineFence
+	case anySpace != 0:
+		return anySpace, anySpaceFence
+	case hard != 0:
+		return hard, hardFence
+	}
+
+	// budget is less than the first rune
+	_, size := utf8.DecodeRuneInString(text)
+	return size, fence
+}
+
+// splitEntities splits text with entities into parts which fit the limit.
+// Entities which span several parts are split as well.
+func splitEntities(text string, entities []MessageEntity, limit int) ([]string, [][]MessageEntity) {
+	parts := []string{}
+	partEntities := [][]MessageEntity{}
+	offset := 0
+
+	for len(text) != 0 {
+		cut := len(text)
+
+		if format.TextLength(text) > limit {
+			cut, _ = findCut(text, "", limit, "")
+		}
+
+		part := strings.TrimRight(text[:cut], "\n")
+		begin := offset
+		end := offset + format.TextLength(part)
+		clipped := []MessageEntity{}
+
+		for _, entity := range entities {
+			from, to := entity.Offset, entity.Offset+entity.Length
+
+			if from < begin {
+				from = begin
+			}
+
+			if to > end {
+				to = end
+			}
+
+			if from < to {
+				entity.Offset = from - begin
+				entity.Length = to - from
+				clipped = append(clipped, entity)
+			}
+		}
+
+		parts = append(parts, part)
+		partEntities = append(partEntities, clipped)
+
+		// skip line breaks between parts
+		rest := strings.TrimLeft(text[cut:], "\n")
+		offset += format.TextLength(text[:len(text)-len(rest)])
+		text = rest
+	}
+
+	return parts, partEntities
+}
@@ -0,0 +1,114 @@
+package srv
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/daskol/telepyth/srv/format"
+)
+
+func TestSplitText(t *testing.T) {
+	text := "*Traceback*:\n```python\n" +
+		strings.Repeat("  File \"train.py\", line 42\n", 10) +
+		"```\nDone."
+
+	parts := splitText(text, "Markdown", 100)
+
+	if len(parts) < 2 {
+		t.Fatal("text is not split: ", parts)
+	}
+
+	for i, part := range parts {
+		if format.TextLength(part) > 100 {
+			t.Error("part is too long: ", i, format.TextLength(part))
+		}
+
+		if strings.Count(part, "```")%2 != 0 {
+			t.Error("code block is not closed: ", part)
+		}
+
+		if i != 0 && !strings.HasPrefix(part, "```python\n") {
+			t.Error("code block is not reopened: ", part)
+		}
+	}
+
+	if !strings.HasSuffix(parts[len(parts)-1], "```\nDone.") {
+		t.Error("wrong last part: ", parts[len(parts)-1])
+	}
+}
+
+func TestSplitTextEntities(t *testing.T) {
+	// inline entity is not broken if there is whitespace outside of it
+	parts := splitText("loss is *very high* now", "Markdown", 18)
+
+	if len(parts) != 2 || parts[0] != "loss is " ||
+		parts[1] != "*very high* now" {
+		t.Error("entity is broken: ", parts)
+	}
+
+	// tag is not broken as well
+	parts = splitText("loss is <b>very high</b> now", "HTML", 24)
+
+	if len(parts) != 2 || parts[1] != "<b>very high</b> now" {
+		t.Error("tag is broken: ", parts)
+	}
+
+	// length is counted in UTF-16 code units
+	if parts := splitText(strings.Repeat("😀", 3), "", 4); len(parts) != 2 {
+		t.Error("wrong number of parts: ", parts)
+	}
+}
+
+func TestNotificationLongText(t *testing.T) {
+	text := strings.Repeat("epoch loss\n", 1000)
+	n := &Notification{ChatId: 1, Text: text, LongMessage: LongMessageDocument}
+
+	if senders := n.Senders(); len(senders) != 1 {
+		t.Fatal("wrong number of requests: ", len(senders))
+	} else if doc, ok := senders[0].(*SendDocument); !ok {
+		t.Error("text is not sent as document: ", senders[0])
+	} else if format.TextLength(doc.Caption) > maxCaptionLength {
+		t.Error("caption is too long: ", format.TextLength(doc.Caption))
+	}
+
+	n.LongMessage = LongMessageSplit
+	senders := n.Senders()
+
+	if len(senders) != 3 {
+		t.Fatal("wrong number of requests: ", len(senders))
+	}
+
+	parts := []string{}
+
+	for _, sender := range senders {
+		parts = append(parts, sender.(*SendMessage).Text)
+	}
+
+	if strings.Join(parts, "\n") != text {
+		t.Error("text is changed on split")
+	}
+}
+
+func TestSplitEntities(t *testing.T) {
+	text := "Loss\n😀 epoch 1\nepoch 2"
+	entities := []MessageEntity{
+		{Type: "bold", Offset: 0, Length: 4},
+		{Type: "pre", Offset: 5, Length: 18},
+	}
+
+	parts, partEntities := splitEntities(text, entities, 16)
+
+	if len(parts) != 2 || parts[0] != "Loss\n😀 epoch 1" || parts[1] != "epoch 2" {
+		t.Fatal("wrong parts: ", parts)
+	}
+
+	// entity which spans both parts is split
+	if len(partEntities[0]) != 2 || partEntities[0][1].Length != 10 {
+		t.Error("wrong entities of the first part: ", partEntities[0])
+	}
+
+	if len(partEntities[1]) != 1 || partEntities[1][0].Offset != 0 ||
+		partEntities[1][0].Length != 7 {
+		t.Error("wrong entities of the second part: ", partEntities[1])
+	}
+}
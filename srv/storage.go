@@ -2,20 +2,58 @@ package srv
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
 	"errors"
 	"github.com/boltdb/bolt"
-	"math/rand"
+	"io/ioutil"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
 //  UserToken represents Telegram user and some system information used to
-//  validate and revoke tokens.
+//  validate and revoke tokens. User could have several tokens which are
+//  distinguished by labels (e.g. laptop or ci). Token itself is not stored,
+//  so Hint is its redacted form which is shown to user.
 type UserToken struct {
 	User
 
 	IsTokenRevoked bool
+	Label          string
+	CreatedAt      time.Time
+	Hint           string
+
+	// Legacy token is a number which is issued before tokens are hashed. It
+	// is valid until it is rotated.
+	Legacy bool
+
+	// Policy restricts usage of token. Uses is number of notifications
+	// which token has sent if number of them is limited.
+	Policy TokenPolicy
+	Uses   int
+
+	// Rotated token is replaced by another one but it stays valid until
+	// grace period is over. Replaces refers to hash of the token which is
+	// rotated in favour of this one.
+	RotatedAt  time.Time
+	GraceUntil time.Time
+	ReplacedBy string
+	Replaces   string
+}
+
+//  IsRotated reports whether token is replaced by another one.
+func (u *UserToken) IsRotated() bool {
+	return len(u.ReplacedBy) != 0
 }
 
 func UserTokenDecode(value []byte) (*UserToken, error) {
@@ -42,23 +80,92 @@ func (u *UserToken) UserTokenEncode() ([]byte, error) {
 	}
 }
 
-var indexName []byte = []byte("index")        // index token -> user
-var revIndexName []byte = []byte("rev-index") // inverted index user -> token
+var indexName []byte = []byte("index")              // index token hash -> user
+var revIndexName []byte = []byte("rev-index")       // inverted index user -> latest token hash
+var tokensName []byte = []byte("tokens")            // user and label -> token hash
+var outboxName []byte = []byte("outbox")            // undelivered notifications
+var outboxIndexName []byte = []byte("outbox-index") // notification -> chat and next attempt
+var deadLetterName []byte = []byte("dead")          // undeliverable notifications
+var receiptsName []byte = []byte("receipts")        // delivery status of notification
+var prefsName []byte = []byte("prefs")              // user -> preferences
+var idempotencyName []byte = []byte("idempotency")  // token and key -> receipt
+var scheduleName []byte = []byte("schedule")        // receipt -> scheduled notification
+var digestName []byte = []byte("digest")            // user and receipt -> held notification
+var metaName []byte = []byte("meta")                // settings of storage
+
+var tokenKeyName []byte = []byte("token-key")     // key of token hashes (legacy)
+var tokenCheckName []byte = []byte("token-check") // hash which verifies key
 
 //  Storage stores persistently information about users and tokens. It is
-//  build on top of BoltDB.
+//  build on top of BoltDB. Tokens are stored as keyed hashes, so they could
+//  not be recovered from database.
 type Storage struct {
 	db  *bolt.DB
-	rnd *rand.Rand
+	key []byte
+}
+
+//  StorageOption configures Storage on construction.
+type StorageOption func(*Storage)
+
+//  WithTokenKey sets secret key of token hashes. If it is not set then key is
+//  generated on the first start and is kept in file next to database (see
+//  TokenKeyPath) since key should not be kept along with hashes.
+func WithTokenKey(key []byte) StorageOption {
+	return func(s *Storage) {
+		s.key = key
+	}
+}
+
+//  ErrWrongTokenKey is returned if tokens in database are hashed with another
+//  key.
+var ErrWrongTokenKey = errors.New("tokens are hashed with another key")
+
+//  TokenKeyPath returns path to file which keeps generated key of token
+//  hashes of database at the given path.
+func TokenKeyPath(path string) string {
+	return path + ".key"
+}
+
+//  readTokenKey reads hex-encoded key of token hashes from file. It returns
+//  nil if there is no such file.
+func readTokenKey(path string) ([]byte, error) {
+	if data, err := ioutil.ReadFile(path); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		return hex.DecodeString(strings.TrimSpace(string(data)))
+	}
+}
+
+//  writeTokenKey writes hex-encoded key of token hashes to file which is
+//  readable by owner only. It fails if file exists.
+func writeTokenKey(path string, key []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+
+	if err != nil {
+		return err
+	} else if _, err := file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return err
+	} else {
+		return file.Close()
+	}
 }
 
-func NewStorage(path string) (*Storage, error) {
+func NewStorage(path string, opts ...StorageOption) (*Storage, error) {
 	db, err := bolt.Open(path, 0600, nil)
 
 	if err != nil {
 		return nil, err
 	}
 
+	s := &Storage{db: db}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
 	// create index and inverse index on start up
 	err = db.Update(func(tx *bolt.Tx) error {
 		if _, err := tx.CreateBucketIfNotExists(indexName); err != nil {
@@ -69,22 +176,142 @@ func NewStorage(path string) (*Storage, error) {
 			return err
 		}
 
-		return nil
+		if _, err := tx.CreateBucketIfNotExists(outboxName); err != nil {
+			return err
+		}
+
+		if err := indexOutbox(tx); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(deadLetterName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(receiptsName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(prefsName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(idempotencyName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(scheduleName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(digestName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(tokensName); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(metaName); err != nil {
+			return err
+		}
+
+		if err := s.initTokenKey(tx, TokenKeyPath(path)); err != nil {
+			return err
+		} else if err := migrateTokens(tx); err != nil {
+			return err
+		}
+
+		return s.migrateTokenHashes(tx)
 	})
 
 	if err != nil {
 		db.Close()
 		return nil, err
 	} else {
-		source := rand.NewSource(time.Now().UnixNano())
-		random := rand.New(source)
-		return &Storage{db, random}, nil
+		return s, nil
+	}
+}
+
+//  initTokenKey loads or generates key of token hashes and checks that the
+//  key is the same as before. Unless key is configured, it is kept in file at
+//  the given path. Key which is kept in database by older versions is moved
+//  to the file.
+func (s *Storage) initTokenKey(tx *bolt.Tx, path string) error {
+	meta := tx.Bucket(metaName)
+	save := false
+
+	if len(s.key) != 0 {
+		// key is configured
+	} else if key, err := readTokenKey(path); err != nil {
+		return err
+	} else if key != nil {
+		s.key = key
+	} else if key := meta.Get(tokenKeyName); key != nil {
+		s.key = append([]byte{}, key...)
+		save = true
+	} else {
+		s.key = make([]byte, sha256.Size)
+		save = true
+
+		if _, err := crand.Read(s.key); err != nil {
+			return err
+		}
+	}
+
+	check := s.HashToken(string(tokenCheckName))
+
+	if value := meta.Get(tokenCheckName); value == nil {
+		if err := meta.Put(tokenCheckName, []byte(check)); err != nil {
+			return err
+		}
+	} else if !sameToken(string(value), check) {
+		return ErrWrongTokenKey
+	}
+
+	// key is saved only once it is checked, and it is never kept along with
+	// hashes
+	if save {
+		if err := writeTokenKey(path, s.key); err != nil {
+			return err
+		}
 	}
+
+	return meta.Delete(tokenKeyName)
 }
 
+//  TokenPrefix starts every token, so leaked tokens are easy to recognize.
+const TokenPrefix = "tp_"
+
+//  NextToken returns random token with 192 bits of entropy.
 func (s *Storage) NextToken() (string, error) {
-	token := strconv.FormatUint(s.rnd.Uint64(), 10)
-	return token, nil
+	value := make([]byte, 24)
+
+	if _, err := crand.Read(value); err != nil {
+		return "", err
+	}
+
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(value), nil
+}
+
+//  HashToken returns keyed hash of token. Hash is stored instead of token and
+//  it refers to token in notifications and receipts.
+func (s *Storage) HashToken(token string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//  isTokenHash reports whether value is hash of token rather than token
+//  itself.
+func isTokenHash(value string) bool {
+	_, err := hex.DecodeString(value)
+	return len(value) == 2*sha256.Size && err == nil
+}
+
+//  sameToken compares tokens or their hashes in constant time.
+func sameToken(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
 }
 
 func (s *Storage) Close() {
@@ -93,11 +320,30 @@ func (s *Storage) Close() {
 	}
 }
 
+//  update runs read-write transaction unless context is cancelled. BoltDB
+//  transactions are short, so they are not interrupted once started.
+func (s *Storage) update(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.Update(fn)
+}
+
+//  view runs read-only transaction unless context is cancelled.
+func (s *Storage) view(ctx context.Context, fn func(*bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.db.View(fn)
+}
+
 func (s *Storage) GenToken(bucket *bolt.Bucket) (string, error) {
 	for i := 0; i != 5; i += 1 {
 		if value, err := s.NextToken(); err != nil {
 			return "", err
-		} else if nested := bucket.Bucket([]byte(value)); nested == nil {
+		} else if bucket.Get([]byte(s.HashToken(value))) == nil {
 			return value, nil
 		}
 	}
@@ -105,44 +351,128 @@ func (s *Storage) GenToken(bucket *bolt.Bucket) (string, error) {
 	return "", errors.New("could no generate new unique token")
 }
 
-func (s *Storage) InsertUser(user *User) (string, error) {
-	token := ""
-	err := s.db.Update(func(tx *bolt.Tx) error {
-		//  generate new key
-		index := tx.Bucket(indexName)
+//  DefaultLabel is a label of token which is issued with /start command.
+const DefaultLabel = "default"
 
-		if value, err := s.GenToken(index); err != nil {
-			return err
-		} else {
-			token = value
-		}
+//  ErrLabelTaken is returned if user already has valid token with the label.
+var ErrLabelTaken = errors.New("label is taken")
 
-		//  insert user in token -> user index
-		user_id := strconv.Itoa(user.Id)
-		userToken := &UserToken{User: *user}
+//  ErrUnknownLabel is returned if user has no valid token with the label.
+var ErrUnknownLabel = errors.New("unknown label")
+
+//  ErrUnknownToken is returned if token is never issued.
+var ErrUnknownToken = errors.New("unknown token")
+
+//  ErrTokenUsedUp is returned if token has sent as many notifications as its
+//  policy allows.
+var ErrTokenUsedUp = errors.New("token is used up")
+
+//  ErrTokenRotated is returned if token is already replaced by another one.
+var ErrTokenRotated = errors.New("token is already rotated")
+
+//  tokenKey makes key of token in tokens bucket. Keys are prefixed with user
+//  in order to list tokens of user at once.
+func tokenKey(user int, label string) []byte {
+	return []byte(strconv.Itoa(user) + "\x00" + label)
+}
+
+//  freeLabel returns label which is not used by user. It is either base or
+//  base with a number (e.g. default-2).
+func freeLabel(tx *bolt.Tx, user int, base string) string {
+	tokens := tx.Bucket(tokensName)
+	label := base
+
+	for i := 2; tokens.Get(tokenKey(user, label)) != nil; i++ {
+		label = base + "-" + strconv.Itoa(i)
+	}
+
+	return label
+}
+
+//  InsertUser issues token of user with default label. If user already has
+//  default token then it is rotated rather than another token is issued, and
+//  the old one stays valid until the given moment.
+func (s *Storage) InsertUser(ctx context.Context, user *User, graceUntil time.Time) (string, error) {
+	token := ""
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		var err error
 
-		if bytes, err := userToken.UserTokenEncode(); err != nil {
+		if hash := tx.Bucket(tokensName).Get(tokenKey(user.Id, DefaultLabel)); hash == nil {
+			token, err = s.insertToken(tx, user, DefaultLabel, TokenPolicy{})
 			return err
-		} else if err := index.Put([]byte(token), bytes); err != nil {
+		} else if token, err = s.rotateToken(tx, string(hash), graceUntil); err != nil {
 			return err
 		}
 
-		//  insert reference user -> token
-		revIndex := tx.Bucket(revIndexName)
+		//  replacement becomes the latest token anyway
+		user_id := []byte(strconv.Itoa(user.Id))
+		return tx.Bucket(revIndexName).Put(user_id, []byte(s.HashToken(token)))
+	})
+	return token, err
+}
 
-		if err := revIndex.Put([]byte(user_id), []byte(token)); err != nil {
-			return err
+//  InsertToken issues new token of user with the label and policy. The token
+//  becomes the latest token of user. Empty label means default one.
+func (s *Storage) InsertToken(ctx context.Context, user *User, label string, policy TokenPolicy) (string, error) {
+	token := ""
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		if len(label) == 0 {
+			label = freeLabel(tx, user.Id, DefaultLabel)
+		} else if tx.Bucket(tokensName).Get(tokenKey(user.Id, label)) != nil {
+			return ErrLabelTaken
 		}
 
-		return nil
+		var err error
+		token, err = s.insertToken(tx, user, label, policy)
+		return err
 	})
 	return token, err
 }
 
-func (s *Storage) SelectUserBy(token string) (*User, error) {
+//  insertToken issues new token of user with the label which is free.
+func (s *Storage) insertToken(tx *bolt.Tx, user *User, label string, policy TokenPolicy) (string, error) {
+	//  generate new key
+	index := tx.Bucket(indexName)
+	token, err := s.GenToken(index)
+
+	if err != nil {
+		return "", err
+	}
+
+	//  insert user in token hash -> user index
+	hash := []byte(s.HashToken(token))
+	user_id := strconv.Itoa(user.Id)
+	userToken := &UserToken{
+		User:      *user,
+		Label:     label,
+		CreatedAt: time.Now(),
+		Hint:      RedactToken(token),
+		Policy:    policy,
+	}
+
+	if bytes, err := userToken.UserTokenEncode(); err != nil {
+		return "", err
+	} else if err := index.Put(hash, bytes); err != nil {
+		return "", err
+	}
+
+	//  insert reference user and label -> token hash
+	if err := tx.Bucket(tokensName).Put(tokenKey(user.Id, label), hash); err != nil {
+		return "", err
+	}
+
+	//  insert reference user -> latest token hash
+	if err := tx.Bucket(revIndexName).Put([]byte(user_id), hash); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+func (s *Storage) SelectUserBy(ctx context.Context, token string) (*User, error) {
 	user := new(User)
-	err := s.db.View(func(tx *bolt.Tx) error {
-		bytes := tx.Bucket(indexName).Get([]byte(token))
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(indexName).Get([]byte(s.HashToken(token)))
 
 		if bytes == nil {
 			user = nil
@@ -159,9 +489,45 @@ func (s *Storage) SelectUserBy(token string) (*User, error) {
 	return user, err
 }
 
-func (s *Storage) SelectTokenBy(user *User) (string, error) {
+//  SelectUserToken returns user and label of token.
+func (s *Storage) SelectUserToken(ctx context.Context, token string) (*UserToken, error) {
+	return s.SelectHashedToken(ctx, s.HashToken(token))
+}
+
+//  SelectHashedToken returns user and label of token by its hash.
+func (s *Storage) SelectHashedToken(ctx context.Context, hash string) (*UserToken, error) {
+	var userToken *UserToken
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(indexName).Get([]byte(hash))
+
+		if bytes == nil {
+			return ErrUnknownToken
+		}
+
+		var err error
+		userToken, err = UserTokenDecode(bytes)
+		return err
+	})
+	return userToken, err
+}
+
+//  SelectLatestTokens returns hashes of the latest tokens of all users, i.e.
+//  one token per user.
+func (s *Storage) SelectLatestTokens(ctx context.Context) ([]string, error) {
+	tokens := []string{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(revIndexName).ForEach(func(k, v []byte) error {
+			tokens = append(tokens, string(v))
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+//  SelectTokenBy returns hash of the latest token of user.
+func (s *Storage) SelectTokenBy(ctx context.Context, user *User) (string, error) {
 	token := ""
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.view(ctx, func(tx *bolt.Tx) error {
 		user_id := strconv.Itoa(user.Id)
 		revIndex := tx.Bucket(revIndexName)
 
@@ -175,45 +541,1411 @@ func (s *Storage) SelectTokenBy(user *User) (string, error) {
 	return token, err
 }
 
-//  RevokeTokenBy revokes access token and implicitly update user info.
-func (s *Storage) RevokeTokenBy(user *User) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
+//  LabeledToken is a valid token of user with its label and policy. Token is
+//  hash of token and Hint is its redacted form.
+type LabeledToken struct {
+	Label     string
+	Token     string
+	Hint      string
+	Legacy    bool
+	CreatedAt time.Time
+	Policy    TokenPolicy
+	Uses      int
+}
+
+//  SelectTokens lists valid tokens of user ordered by label.
+func (s *Storage) SelectTokens(ctx context.Context, user *User) ([]LabeledToken, error) {
+	tokens := []LabeledToken{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		prefix := tokenKey(user.Id, "")
+		cursor := tx.Bucket(tokensName).Cursor()
+		index := tx.Bucket(indexName)
+
+		for k, v := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Next() {
+			token := LabeledToken{Label: string(k[len(prefix):]), Token: string(v)}
+
+			if value := index.Get(v); value == nil {
+				continue
+			} else if ut, err := UserTokenDecode(value); err != nil {
+				return err
+			} else {
+				token.Hint = ut.Hint
+				token.Legacy = ut.Legacy
+				token.CreatedAt = ut.CreatedAt
+				token.Policy = ut.Policy
+				token.Uses = ut.Uses
+			}
+
+			tokens = append(tokens, token)
+		}
+
+		return nil
+	})
+	return tokens, err
+}
+
+//  RevokeTokenBy revokes the latest token of user and implicitly update user
+//  info.
+func (s *Storage) RevokeTokenBy(ctx context.Context, user *User) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
 		user_id := strconv.Itoa(user.Id)
-		revIndex := tx.Bucket(revIndexName)
-		token := []byte{}
+		token := tx.Bucket(revIndexName).Get([]byte(user_id))
 
-		if token = revIndex.Get([]byte(user_id)); token == nil {
+		if token == nil {
 			return errors.New("unknown user")
 		}
 
-		userToken := &UserToken{User: *user, IsTokenRevoked: true}
+		return revokeToken(tx, user, string(token))
+	})
+}
+
+//  RevokeToken revokes token of user with the label.
+func (s *Storage) RevokeToken(ctx context.Context, user *User, label string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		token := tx.Bucket(tokensName).Get(tokenKey(user.Id, label))
+
+		if token == nil {
+			return ErrUnknownLabel
+		}
+
+		return revokeToken(tx, user, string(token))
+	})
+}
+
+//  revokeToken marks token with the hash as revoked and forgets its label. If
+//  the token is the latest token of user then another valid token becomes the
+//  latest. Tokens which are rotated in favour of the token are revoked as
+//  well.
+func revokeToken(tx *bolt.Tx, user *User, token string) error {
+	index := tx.Bucket(indexName)
+	value := index.Get([]byte(token))
 
-		if bytes, err := userToken.UserTokenEncode(); err != nil {
+	if value == nil {
+		return errors.New("unknown token")
+	}
+
+	userToken, err := UserTokenDecode(value)
+
+	if err != nil {
+		return err
+	}
+
+	userToken.User = *user
+	userToken.IsTokenRevoked = true
+
+	if bytes, err := userToken.UserTokenEncode(); err != nil {
+		return err
+	} else if err := index.Put([]byte(token), bytes); err != nil {
+		return err
+	}
+
+	if len(userToken.Replaces) != 0 {
+		if err := revokeToken(tx, user, userToken.Replaces); err != nil {
 			return err
-		} else if err := tx.Bucket(indexName).Put(token, bytes); err != nil {
+		}
+	}
+
+	tokens := tx.Bucket(tokensName)
+	key := tokenKey(user.Id, userToken.Label)
+
+	if value := tokens.Get(key); value != nil && string(value) == token {
+		if err := tokens.Delete(key); err != nil {
 			return err
-		} else {
-			return nil
 		}
+	}
+
+	//  point to any other valid token
+	user_id := []byte(strconv.Itoa(user.Id))
+	revIndex := tx.Bucket(revIndexName)
+
+	if string(revIndex.Get(user_id)) != token {
+		return nil
+	}
+
+	prefix := tokenKey(user.Id, "")
+
+	if k, v := tokens.Cursor().Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) {
+		return revIndex.Put(user_id, v)
+	}
+
+	return nil
+}
+
+//  RotateToken issues a replacement of token. The replacement gets the same
+//  label, policy and number of uses and it becomes the latest token of user
+//  if the old one is. The old token stays valid until the given moment and
+//  its uses are counted by the replacement meanwhile.
+func (s *Storage) RotateToken(ctx context.Context, token string, graceUntil time.Time) (string, error) {
+	replacement := ""
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		var err error
+		replacement, err = s.rotateToken(tx, s.HashToken(token), graceUntil)
+		return err
 	})
+	return replacement, err
 }
 
-//  IsTokenRevokedBy test whether access token was revoked.
-func (s *Storage) IsTokenRevokedBy(token string) (bool, error) {
-	revoked := true
-	err := s.db.View(func(tx *bolt.Tx) error {
-		bytes := tx.Bucket(indexName).Get([]byte(token))
+//  RotateTokenBy rotates token of user with the label. Empty label means
+//  the latest token. It returns replacement and label of rotated token.
+func (s *Storage) RotateTokenBy(ctx context.Context, user *User, label string, graceUntil time.Time) (string, string, error) {
+	replacement := ""
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		var token []byte
 
-		if bytes == nil {
-			return errors.New("unknown user")
+		if len(label) == 0 {
+			token = tx.Bucket(revIndexName).Get([]byte(strconv.Itoa(user.Id)))
+		} else {
+			token = tx.Bucket(tokensName).Get(tokenKey(user.Id, label))
 		}
 
-		if ut, err := UserTokenDecode(bytes); err != nil {
+		if token == nil {
+			return ErrUnknownLabel
+		}
+
+		if value := tx.Bucket(indexName).Get(token); value == nil {
+			return ErrUnknownLabel
+		} else if ut, err := UserTokenDecode(value); err != nil {
 			return err
 		} else {
-			revoked = ut.IsTokenRevoked
-			return nil
+			label = ut.Label
 		}
+
+		var err error
+		replacement, err = s.rotateToken(tx, string(token), graceUntil)
+		return err
+	})
+	return replacement, label, err
+}
+
+//  rotateToken rotates token with the hash and returns replacement.
+func (s *Storage) rotateToken(tx *bolt.Tx, token string, graceUntil time.Time) (string, error) {
+	index := tx.Bucket(indexName)
+	value := index.Get([]byte(token))
+
+	if value == nil {
+		return "", ErrUnknownToken
+	}
+
+	old, err := UserTokenDecode(value)
+
+	if err != nil {
+		return "", err
+	} else if old.IsTokenRevoked {
+		return "", ErrUnknownToken
+	} else if old.IsRotated() {
+		return "", ErrTokenRotated
+	}
+
+	replacement, err := s.GenToken(index)
+
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	hash := s.HashToken(replacement)
+	userToken := &UserToken{
+		User:      old.User,
+		Label:     old.Label,
+		CreatedAt: now,
+		Hint:      RedactToken(replacement),
+		Policy:    old.Policy,
+		Uses:      old.Uses,
+		Replaces:  token,
+	}
+
+	old.RotatedAt = now
+	old.GraceUntil = graceUntil
+	old.ReplacedBy = hash
+
+	for key, ut := range map[string]*UserToken{token: old, hash: userToken} {
+		if bytes, err := ut.UserTokenEncode(); err != nil {
+			return "", err
+		} else if err := index.Put([]byte(key), bytes); err != nil {
+			return "", err
+		}
+	}
+
+	//  label and the latest token refer to replacement
+	key := tokenKey(old.Id, old.Label)
+
+	if err := tx.Bucket(tokensName).Put(key, []byte(hash)); err != nil {
+		return "", err
+	}
+
+	user_id := []byte(strconv.Itoa(old.Id))
+	revIndex := tx.Bucket(revIndexName)
+
+	if string(revIndex.Get(user_id)) == token {
+		if err := revIndex.Put(user_id, []byte(hash)); err != nil {
+			return "", err
+		}
+	}
+
+	return replacement, nil
+}
+
+//  lineage returns hashes of tokens which are rotated in favour of each other
+//  starting from token with the hash. Notifications, receipts and scheduled
+//  notifications of any token of lineage belong to all of them.
+func lineage(tx *bolt.Tx, hash string) map[string]bool {
+	index := tx.Bucket(indexName)
+	hashes := map[string]bool{hash: true}
+
+	for _, back := range []bool{true, false} {
+		for next := hash; ; {
+			value := index.Get([]byte(next))
+
+			if value == nil {
+				break
+			}
+
+			ut, err := UserTokenDecode(value)
+
+			if err != nil {
+				break
+			} else if back {
+				next = ut.Replaces
+			} else {
+				next = ut.ReplacedBy
+			}
+
+			if len(next) == 0 || hashes[next] {
+				break
+			}
+
+			hashes[next] = true
+		}
+	}
+
+	return hashes
+}
+
+//  SameLineage reports whether tokens with the hashes are rotated in favour
+//  of each other (or they are the same). It reports false if tokens could
+//  not be read.
+func (s *Storage) SameLineage(ctx context.Context, a, b string) bool {
+	same := false
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		same = len(a) != 0 && lineage(tx, a)[b]
+		return nil
+	})
+	return err == nil && same
+}
+
+//  consumeToken counts notification which token with the hash sends. It
+//  returns ErrTokenUsedUp if token could not send more notifications.
+//  Notifications without token (e.g. announcements) are not counted. Rotated
+//  token shares uses with its replacement, so uses are counted by the latest
+//  token of the lineage.
+func consumeToken(tx *bolt.Tx, hash string) error {
+	index := tx.Bucket(indexName)
+	value := index.Get([]byte(hash))
+
+	if len(hash) == 0 || value == nil {
+		return nil
+	}
+
+	ut, err := UserTokenDecode(value)
+
+	for err == nil && ut.IsRotated() {
+		if value = index.Get([]byte(ut.ReplacedBy)); value == nil {
+			return ErrUnknownToken
+		}
+
+		hash = ut.ReplacedBy
+		ut, err = UserTokenDecode(value)
+	}
+
+	if err != nil {
+		return err
+	} else if ut.Policy.MaxUses == 0 {
+		return nil
+	} else if ut.Uses >= ut.Policy.MaxUses {
+		return ErrTokenUsedUp
+	}
+
+	ut.Uses += 1
+
+	if bytes, err := ut.UserTokenEncode(); err != nil {
+		return err
+	} else {
+		return index.Put([]byte(hash), bytes)
+	}
+}
+
+//  IsTokenRevokedBy test whether access token with the hash was revoked.
+func (s *Storage) IsTokenRevokedBy(ctx context.Context, token string) (bool, error) {
+	revoked := true
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(indexName).Get([]byte(token))
+
+		if bytes == nil {
+			return errors.New("unknown user")
+		}
+
+		if ut, err := UserTokenDecode(bytes); err != nil {
+			return err
+		} else {
+			revoked = ut.IsTokenRevoked
+			return nil
+		}
+	})
+	return revoked, err
+}
+
+//  migrateTokens labels valid tokens which were issued before users could
+//  have several tokens. The latest token of user gets default label and the
+//  others get numbered ones, so they could be listed and revoked.
+func migrateTokens(tx *bolt.Tx) error {
+	index := tx.Bucket(indexName)
+	revIndex := tx.Bucket(revIndexName)
+	unlabelled := map[string]*UserToken{}
+	order := []string{}
+
+	err := index.ForEach(func(k, v []byte) error {
+		if ut, err := UserTokenDecode(v); err != nil {
+			return err
+		} else if !ut.IsTokenRevoked && len(ut.Label) == 0 {
+			unlabelled[string(k)] = ut
+			order = append(order, string(k))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// the latest tokens are labelled first
+	sort.SliceStable(order, func(i, j int) bool {
+		latest := func(token string) bool {
+			user_id := strconv.Itoa(unlabelled[token].Id)
+			return string(revIndex.Get([]byte(user_id))) == token
+		}
+
+		return latest(order[i]) && !latest(order[j])
+	})
+
+	for _, token := range order {
+		ut := unlabelled[token]
+		ut.Label = freeLabel(tx, ut.Id, DefaultLabel)
+
+		if bytes, err := ut.UserTokenEncode(); err != nil {
+			return err
+		} else if err := index.Put([]byte(token), bytes); err != nil {
+			return err
+		} else if err := tx.Bucket(tokensName).Put(tokenKey(ut.Id, ut.Label), []byte(token)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//  migrateTokenHashes replaces tokens which are issued before tokens are
+//  hashed with their hashes. Such tokens are marked as legacy ones. Tokens in
+//  notifications, receipts and idempotency keys are replaced as well.
+func (s *Storage) migrateTokenHashes(tx *bolt.Tx) error {
+	hash := func(token string) string {
+		if len(token) == 0 || isTokenHash(token) {
+			return token
+		}
+
+		return s.HashToken(token)
+	}
+
+	// collect changes first since bucket could not be modified during
+	// iteration
+	rehash := func(name []byte, fn func(k, v []byte) ([]byte, []byte, error)) error {
+		bucket := tx.Bucket(name)
+		keys, values := [][]byte{}, [][]byte{}
+
+		err := bucket.ForEach(func(k, v []byte) error {
+			if key, value, err := fn(k, v); err != nil {
+				return err
+			} else if value != nil {
+				keys = append(keys, append([]byte{}, k...), append([]byte{}, key...))
+				values = append(values, nil, value)
+			}
+
+			return nil
+		})
+
+		for i := 0; err == nil && i != len(keys); i++ {
+			if values[i] == nil {
+				err = bucket.Delete(keys[i])
+			} else {
+				err = bucket.Put(keys[i], values[i])
+			}
+		}
+
+		return err
+	}
+
+	err := rehash(indexName, func(k, v []byte) ([]byte, []byte, error) {
+		if isTokenHash(string(k)) {
+			return nil, nil, nil
+		}
+
+		ut, err := UserTokenDecode(v)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		ut.Hint = RedactToken(string(k))
+		ut.Legacy = true
+		ut.ReplacedBy = hash(ut.ReplacedBy)
+		ut.Replaces = hash(ut.Replaces)
+		value, err := ut.UserTokenEncode()
+		return []byte(hash(string(k))), value, err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// references to tokens
+	for _, name := range [][]byte{revIndexName, tokensName} {
+		err := rehash(name, func(k, v []byte) ([]byte, []byte, error) {
+			if isTokenHash(string(v)) {
+				return nil, nil, nil
+			}
+
+			return k, []byte(hash(string(v))), nil
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, name := range [][]byte{outboxName, deadLetterName, scheduleName, digestName} {
+		err := rehash(name, func(k, v []byte) ([]byte, []byte, error) {
+			n, err := NotificationDecode(v)
+
+			if err != nil || n.Token == hash(n.Token) {
+				return nil, nil, err
+			}
+
+			n.Token = hash(n.Token)
+			value, err := n.NotificationEncode()
+			return k, value, err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rehash(receiptsName, func(k, v []byte) ([]byte, []byte, error) {
+		r, err := ReceiptDecode(v)
+
+		if err != nil || r.Token == hash(r.Token) {
+			return nil, nil, err
+		}
+
+		r.Token = hash(r.Token)
+		value, err := r.ReceiptEncode()
+		return k, value, err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// idempotency keys are prefixed with token
+	return rehash(idempotencyName, func(k, v []byte) ([]byte, []byte, error) {
+		parts := bytes.SplitN(k, []byte("\x00"), 2)
+
+		if len(parts) != 2 || isTokenHash(string(parts[0])) {
+			return nil, nil, nil
+		}
+
+		key := hash(string(parts[0])) + "\x00" + string(parts[1])
+		return []byte(key), append([]byte{}, v...), nil
+	})
+}
+
+func NotificationDecode(value []byte) (*Notification, error) {
+	n := &Notification{}
+	buffer := bytes.NewBuffer(value)
+	dec := gob.NewDecoder(buffer)
+
+	if err := dec.Decode(n); err != nil {
+		return nil, err
+	} else {
+		return n, nil
+	}
+}
+
+func (n *Notification) NotificationEncode() ([]byte, error) {
+	var buffer bytes.Buffer
+
+	enc := gob.NewEncoder(&buffer)
+
+	if err := enc.Encode(*n); err != nil {
+		return nil, err
+	} else {
+		return buffer.Bytes(), nil
+	}
+}
+
+//  itob encodes identifier in big endian order in order to keep keys sorted.
+func itob(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+//  PutNotification inserts notification into outbox or updates it there. New
+//  notification is assigned with unique identifier and receipt in state
+//  queued. Otherwise, receipt keeps the last delivery error.
+func (s *Storage) PutNotification(ctx context.Context, n *Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		outbox := tx.Bucket(outboxName)
+
+		if n.Id == 0 {
+			if id, err := outbox.NextSequence(); err != nil {
+				return err
+			} else {
+				n.Id = id
+			}
+
+			if err := acceptNotification(tx, n, StateQueued); err != nil {
+				return err
+			}
+		} else {
+			err := updateReceipts(tx, n, func(r *Receipt) {
+				r.State = StateQueued
+				r.Error = n.LastError
+				r.Fallback = n.Fallback
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return putOutbox(tx, n)
+	})
+}
+
+//  acceptNotification assigns receipt in the given state to new notification,
+//  binds its idempotency key and counts use of its token.
+func acceptNotification(tx *bolt.Tx, n *Notification, state string) error {
+	if id, err := NextReceiptId(); err != nil {
+		return err
+	} else {
+		n.ReceiptId = id
+	}
+
+	if len(n.IdempotencyKey) == 0 {
+		// request could not be repeated
+	} else if err := bindIdempotencyKey(tx, n); err != nil {
+		return err
+	}
+
+	//  repeated request is not counted since it returns above
+	if err := consumeToken(tx, n.Token); err != nil {
+		return err
+	}
+
+	receipt := &Receipt{
+		Id:             n.ReceiptId,
+		NotificationId: n.Id,
+		Token:          n.Token,
+		ChatId:         n.ChatId,
+		Media:          n.IsMedia(),
+		Label:          n.Label,
+		Digest:         state == StateHeld,
+		State:          state,
+		CreatedAt:      n.CreatedAt,
+		UpdatedAt:      n.CreatedAt,
+	}
+
+	if !n.SendAt.IsZero() {
+		sendAt := n.SendAt
+		receipt.SendAt = &sendAt
+	}
+
+	return putReceipt(tx, receipt)
+}
+
+//  SelectNotification returns notification from outbox or nil if there is no
+//  such notification there.
+func (s *Storage) SelectNotification(ctx context.Context, id uint64) (*Notification, error) {
+	var n *Notification
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(outboxName).Get(itob(id))
+
+		if bytes == nil {
+			return nil
+		}
+
+		var err error
+		n, err = NotificationDecode(bytes)
+		return err
+	})
+	return n, err
+}
+
+//  OutboxEntry refers to notification in outbox. It is light, so outbox is
+//  scanned without loading attachments of notifications.
+type OutboxEntry struct {
+	Id          uint64
+	ChatId      int
+	NextAttempt time.Time
+}
+
+func outboxEntryDecode(key, value []byte) (*OutboxEntry, error) {
+	if len(key) != 8 || len(value) != 16 {
+		return nil, errors.New("malformed outbox entry")
+	}
+
+	return &OutboxEntry{
+		Id:          binary.BigEndian.Uint64(key),
+		ChatId:      int(int64(binary.BigEndian.Uint64(value[:8]))),
+		NextAttempt: time.Unix(0, int64(binary.BigEndian.Uint64(value[8:]))),
+	}, nil
+}
+
+func outboxEntryEncode(n *Notification) []byte {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value[:8], uint64(int64(n.ChatId)))
+	binary.BigEndian.PutUint64(value[8:], uint64(n.NextAttempt.UnixNano()))
+	return value
+}
+
+//  putOutbox puts notification into outbox and indexes it.
+func putOutbox(tx *bolt.Tx, n *Notification) error {
+	if bytes, err := n.NotificationEncode(); err != nil {
+		return err
+	} else if err := tx.Bucket(outboxName).Put(itob(n.Id), bytes); err != nil {
+		return err
+	} else {
+		return tx.Bucket(outboxIndexName).Put(itob(n.Id), outboxEntryEncode(n))
+	}
+}
+
+//  deleteOutbox removes notification from outbox and from its index.
+func deleteOutbox(tx *bolt.Tx, id uint64) error {
+	if err := tx.Bucket(outboxName).Delete(itob(id)); err != nil {
+		return err
+	} else {
+		return tx.Bucket(outboxIndexName).Delete(itob(id))
+	}
+}
+
+//  indexOutbox builds index of outbox if database is created before the
+//  index is.
+func indexOutbox(tx *bolt.Tx) error {
+	if tx.Bucket(outboxIndexName) != nil {
+		return nil
+	}
+
+	index, err := tx.CreateBucket(outboxIndexName)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(outboxName).ForEach(func(k, v []byte) error {
+		if n, err := NotificationDecode(v); err != nil {
+			return err
+		} else {
+			return index.Put(k, outboxEntryEncode(n))
+		}
+	})
+}
+
+//  SelectOutbox returns entries of all notifications in outbox whether they
+//  are due or not. Entries are ordered by time of acceptance.
+func (s *Storage) SelectOutbox(ctx context.Context) ([]*OutboxEntry, error) {
+	entries := []*OutboxEntry{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxIndexName).ForEach(func(k, v []byte) error {
+			if entry, err := outboxEntryDecode(k, v); err != nil {
+				return err
+			} else {
+				entries = append(entries, entry)
+				return nil
+			}
+		})
+	})
+	return entries, err
+}
+
+//  CompleteNotification removes delivered notification from outbox and
+//  stores identifier of Telegram message in its receipt.
+func (s *Storage) CompleteNotification(ctx context.Context, n *Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if err := deleteOutbox(tx, n.Id); err != nil {
+			return err
+		}
+
+		return updateReceipts(tx, n, func(r *Receipt) {
+			r.State = StateSent
+			r.Error = ""
+			r.MessageId = n.MessageId
+			r.Fallback = n.Fallback
+		})
+	})
+}
+
+//  BuryNotification moves notification from outbox to dead-letter bucket.
+func (s *Storage) BuryNotification(ctx context.Context, n *Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if err := deleteOutbox(tx, n.Id); err != nil {
+			return err
+		}
+
+		if bytes, err := n.NotificationEncode(); err != nil {
+			return err
+		} else if err := tx.Bucket(deadLetterName).Put(itob(n.Id), bytes); err != nil {
+			return err
+		}
+
+		return updateReceipts(tx, n, func(r *Receipt) {
+			r.State = StateFailed
+			r.Error = n.LastError
+			r.Fallback = n.Fallback
+		})
+	})
+}
+
+//  SelectDeadNotifications lists notifications from dead-letter bucket.
+func (s *Storage) SelectDeadNotifications(ctx context.Context) ([]*Notification, error) {
+	notifications := []*Notification{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLetterName).ForEach(func(k, v []byte) error {
+			if n, err := NotificationDecode(v); err != nil {
+				return err
+			} else {
+				notifications = append(notifications, n)
+				return nil
+			}
+		})
+	})
+	return notifications, err
+}
+
+//  RequeueNotification moves notification from dead-letter bucket back to
+//  outbox and resets number of delivery attempts.
+func (s *Storage) RequeueNotification(ctx context.Context, id uint64) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadLetterName)
+		bytes := dead.Get(itob(id))
+
+		if bytes == nil {
+			return errors.New("unknown notification")
+		}
+
+		n, err := NotificationDecode(bytes)
+
+		if err != nil {
+			return err
+		}
+
+		n.Attempts = 0
+		n.NextAttempt = time.Now()
+
+		if err := putOutbox(tx, n); err != nil {
+			return err
+		} else if err := dead.Delete(itob(id)); err != nil {
+			return err
+		}
+
+		return updateReceipts(tx, n, func(r *Receipt) {
+			r.State = StateQueued
+		})
+	})
+}
+
+//  DeleteDeadNotification drops notification from dead-letter bucket.
+func (s *Storage) DeleteDeadNotification(ctx context.Context, id uint64) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadLetterName)
+
+		if dead.Get(itob(id)) == nil {
+			return errors.New("unknown notification")
+		}
+
+		return dead.Delete(itob(id))
+	})
+}
+
+//  PruneDeadNotifications drops notifications from dead-letter bucket which
+//  are attempted for the last time before given moment.
+func (s *Storage) PruneDeadNotifications(ctx context.Context, before time.Time) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		dead := tx.Bucket(deadLetterName)
+		expired := [][]byte{}
+
+		err := dead.ForEach(func(k, v []byte) error {
+			if n, err := NotificationDecode(v); err != nil {
+				return err
+			} else if n.NextAttempt.Before(before) {
+				expired = append(expired, k)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := dead.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func ReceiptDecode(value []byte) (*Receipt, error) {
+	r := &Receipt{}
+	buffer := bytes.NewBuffer(value)
+	dec := gob.NewDecoder(buffer)
+
+	if err := dec.Decode(r); err != nil {
+		return nil, err
+	} else {
+		return r, nil
+	}
+}
+
+func (r *Receipt) ReceiptEncode() ([]byte, error) {
+	var buffer bytes.Buffer
+
+	enc := gob.NewEncoder(&buffer)
+
+	if err := enc.Encode(*r); err != nil {
+		return nil, err
+	} else {
+		return buffer.Bytes(), nil
+	}
+}
+
+//  NextReceiptId generates random identifier of receipt. It is hard to guess
+//  since it is the only credential to query delivery status.
+func NextReceiptId() (string, error) {
+	id := make([]byte, 16)
+
+	if _, err := crand.Read(id); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+func putReceipt(tx *bolt.Tx, r *Receipt) error {
+	if bytes, err := r.ReceiptEncode(); err != nil {
+		return err
+	} else {
+		return tx.Bucket(receiptsName).Put([]byte(r.Id), bytes)
+	}
+}
+
+//  updateReceipt applies changes to receipt and updates its timestamp. It is
+//  not an error if receipt does not exist (e.g. it is already expired).
+func updateReceipt(tx *bolt.Tx, id string, update func(*Receipt)) error {
+	bytes := tx.Bucket(receiptsName).Get([]byte(id))
+
+	if bytes == nil {
+		return nil
+	}
+
+	r, err := ReceiptDecode(bytes)
+
+	if err != nil {
+		return err
+	}
+
+	update(r)
+	r.UpdatedAt = time.Now()
+
+	return putReceipt(tx, r)
+}
+
+//  updateReceipts applies changes to receipt of notification and to receipts
+//  of notifications which are collected into its digest.
+func updateReceipts(tx *bolt.Tx, n *Notification, update func(*Receipt)) error {
+	for _, id := range append([]string{n.ReceiptId}, n.Digest...) {
+		if err := updateReceipt(tx, id, update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//  SelectReceipt returns receipt by its identifier.
+func (s *Storage) SelectReceipt(ctx context.Context, id string) (*Receipt, error) {
+	var r *Receipt
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		bytes := tx.Bucket(receiptsName).Get([]byte(id))
+
+		if bytes == nil {
+			return errors.New("unknown receipt")
+		}
+
+		var err error
+		r, err = ReceiptDecode(bytes)
+		return err
+	})
+	return r, err
+}
+
+//  EditReceipt records that message of receipt is edited, so receipt is kept
+//  while message is being updated. Fallback reports whether the last edit is
+//  sent without formatting.
+func (s *Storage) EditReceipt(ctx context.Context, id string, fallback bool) (*Receipt, error) {
+	var r *Receipt
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(receiptsName).Get([]byte(id)) == nil {
+			return errors.New("unknown receipt")
+		}
+
+		return updateReceipt(tx, id, func(receipt *Receipt) {
+			receipt.Fallback = fallback
+			r = receipt
+		})
+	})
+	return r, err
+}
+
+//  PruneReceipts removes receipts of finished deliveries which were not
+//  updated since given moment.
+func (s *Storage) PruneReceipts(ctx context.Context, before time.Time) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		receipts := tx.Bucket(receiptsName)
+		expired := [][]byte{}
+
+		err := receipts.ForEach(func(k, v []byte) error {
+			if r, err := ReceiptDecode(v); err != nil {
+				return err
+			} else if r.IsFinal() && r.UpdatedAt.Before(before) {
+				expired = append(expired, k)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := receipts.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//  Preferences are settings which user chooses with bot commands. They are
+//  applied to notifications unless request overrides them.
+type Preferences struct {
+	LongMessage string
+
+	// DigestInterval is how often non-urgent notifications are sent as a
+	// single summary. If DigestDaily is set then summary is sent once a day
+	// at DigestAt after midnight instead.
+	DigestInterval time.Duration
+	DigestDaily    bool
+	DigestAt       time.Duration
+
+	// QuietFrom and QuietTo bound quiet hours in time zone of user. Non-urgent
+	// notifications are sent silently within quiet hours or, if QuietHold is
+	// set, they are held until quiet hours are over.
+	Quiet     bool
+	QuietFrom time.Duration
+	QuietTo   time.Duration
+	QuietHold bool
+
+	// Timezone is IANA name of time zone of user (e.g. Europe/Moscow). It is
+	// UTC by default.
+	Timezone string
+}
+
+func PreferencesDecode(value []byte) (*Preferences, error) {
+	p := &Preferences{}
+	buffer := bytes.NewBuffer(value)
+	dec := gob.NewDecoder(buffer)
+
+	if err := dec.Decode(p); err != nil {
+		return nil, err
+	} else {
+		return p, nil
+	}
+}
+
+func (p *Preferences) PreferencesEncode() ([]byte, error) {
+	var buffer bytes.Buffer
+
+	enc := gob.NewEncoder(&buffer)
+
+	if err := enc.Encode(*p); err != nil {
+		return nil, err
+	} else {
+		return buffer.Bytes(), nil
+	}
+}
+
+//  SelectPreferences returns preferences of user. User who has not changed
+//  anything gets default preferences.
+func (s *Storage) SelectPreferences(ctx context.Context, user *User) (*Preferences, error) {
+	p := &Preferences{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		user_id := strconv.Itoa(user.Id)
+		bytes := tx.Bucket(prefsName).Get([]byte(user_id))
+
+		if bytes == nil {
+			return nil
+		}
+
+		var err error
+		p, err = PreferencesDecode(bytes)
+		return err
+	})
+	return p, err
+}
+
+//  UpdatePreferences applies changes to preferences of user.
+func (s *Storage) UpdatePreferences(ctx context.Context, user *User, update func(*Preferences)) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		user_id := strconv.Itoa(user.Id)
+		prefs := tx.Bucket(prefsName)
+		p := &Preferences{}
+
+		if bytes := prefs.Get([]byte(user_id)); bytes != nil {
+			var err error
+
+			if p, err = PreferencesDecode(bytes); err != nil {
+				return err
+			}
+		}
+
+		update(p)
+
+		if bytes, err := p.PreferencesEncode(); err != nil {
+			return err
+		} else {
+			return prefs.Put([]byte(user_id), bytes)
+		}
+	})
+}
+
+//  ErrRepeatedRequest is returned if notification with the same idempotency
+//  key is already accepted.
+var ErrRepeatedRequest = errors.New("request is repeated")
+
+//  IdempotencyKey refers to receipt of notification which is accepted with
+//  the key.
+type IdempotencyKey struct {
+	ReceiptId string
+	CreatedAt time.Time
+}
+
+func IdempotencyKeyDecode(value []byte) (*IdempotencyKey, error) {
+	k := &IdempotencyKey{}
+	buffer := bytes.NewBuffer(value)
+	dec := gob.NewDecoder(buffer)
+
+	if err := dec.Decode(k); err != nil {
+		return nil, err
+	} else {
+		return k, nil
+	}
+}
+
+func (k *IdempotencyKey) IdempotencyKeyEncode() ([]byte, error) {
+	var buffer bytes.Buffer
+
+	enc := gob.NewEncoder(&buffer)
+
+	if err := enc.Encode(*k); err != nil {
+		return nil, err
+	} else {
+		return buffer.Bytes(), nil
+	}
+}
+
+//  bindIdempotencyKey binds idempotency key of new notification to its
+//  receipt. Keys are scoped by token. If the key is already bound then
+//  receipt of original notification is assigned and ErrRepeatedRequest is
+//  returned.
+func bindIdempotencyKey(tx *bolt.Tx, n *Notification) error {
+	keys := tx.Bucket(idempotencyName)
+	key := []byte(n.Token + "\x00" + n.IdempotencyKey)
+
+	if bytes := keys.Get(key); bytes != nil {
+		if k, err := IdempotencyKeyDecode(bytes); err != nil {
+			return err
+		} else {
+			n.Id = 0
+			n.ReceiptId = k.ReceiptId
+			return ErrRepeatedRequest
+		}
+	}
+
+	k := &IdempotencyKey{ReceiptId: n.ReceiptId, CreatedAt: n.CreatedAt}
+
+	if bytes, err := k.IdempotencyKeyEncode(); err != nil {
+		return err
+	} else {
+		return keys.Put(key, bytes)
+	}
+}
+
+//  PruneIdempotencyKeys removes idempotency keys which were bound before
+//  given moment.
+func (s *Storage) PruneIdempotencyKeys(ctx context.Context, before time.Time) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		keys := tx.Bucket(idempotencyName)
+		expired := [][]byte{}
+
+		err := keys.ForEach(func(k, v []byte) error {
+			if key, err := IdempotencyKeyDecode(v); err != nil {
+				return err
+			} else if key.CreatedAt.Before(before) {
+				expired = append(expired, k)
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := keys.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//  ErrUnknownScheduled is returned if there is no scheduled notification with
+//  the receipt (e.g. it is already sent or cancelled).
+var ErrUnknownScheduled = errors.New("unknown scheduled notification")
+
+//  ScheduleNotification stores notification until it is due. Notification is
+//  assigned with receipt in state scheduled. It gets identifier only when it
+//  is moved to outbox.
+func (s *Storage) ScheduleNotification(ctx context.Context, n *Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if err := acceptNotification(tx, n, StateScheduled); err != nil {
+			return err
+		}
+
+		if bytes, err := n.NotificationEncode(); err != nil {
+			return err
+		} else {
+			return tx.Bucket(scheduleName).Put([]byte(n.ReceiptId), bytes)
+		}
+	})
+}
+
+//  selectScheduled returns scheduled notifications which satisfy predicate.
+//  Notifications are ordered by moment of sending.
+func (s *Storage) selectScheduled(ctx context.Context, fn func(*Notification) bool) ([]*Notification, error) {
+	notifications := []*Notification{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduleName).ForEach(func(k, v []byte) error {
+			if n, err := NotificationDecode(v); err != nil {
+				return err
+			} else if fn(n) {
+				notifications = append(notifications, n)
+			}
+
+			return nil
+		})
+	})
+
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].SendAt.Before(notifications[j].SendAt)
+	})
+
+	return notifications, err
+}
+
+//  SelectDueScheduled returns scheduled notifications which should be sent
+//  not later than given moment.
+func (s *Storage) SelectDueScheduled(ctx context.Context, now time.Time) ([]*Notification, error) {
+	return s.selectScheduled(ctx, func(n *Notification) bool {
+		return !n.SendAt.After(now)
+	})
+}
+
+//  SelectScheduled returns pending notifications which are scheduled with
+//  token which has the hash or with any token of its lineage.
+func (s *Storage) SelectScheduled(ctx context.Context, token string) ([]*Notification, error) {
+	var hashes map[string]bool
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		hashes = lineage(tx, token)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.selectScheduled(ctx, func(n *Notification) bool {
+		return hashes[n.Token]
+	})
+}
+
+//  ReleaseScheduled moves scheduled notification to outbox. Notification is
+//  assigned with unique identifier and its receipt becomes queued. It returns
+//  ErrUnknownScheduled if notification is cancelled meanwhile.
+func (s *Storage) ReleaseScheduled(ctx context.Context, n *Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(scheduleName)
+		outbox := tx.Bucket(outboxName)
+
+		if schedule.Get([]byte(n.ReceiptId)) == nil {
+			return ErrUnknownScheduled
+		}
+
+		if id, err := outbox.NextSequence(); err != nil {
+			return err
+		} else {
+			n.Id = id
+			n.NextAttempt = time.Now()
+		}
+
+		if err := putOutbox(tx, n); err != nil {
+			return err
+		} else if err := schedule.Delete([]byte(n.ReceiptId)); err != nil {
+			return err
+		}
+
+		return updateReceipt(tx, n.ReceiptId, func(r *Receipt) {
+			r.State = StateQueued
+			r.NotificationId = n.Id
+		})
+	})
+}
+
+//  CancelScheduled drops scheduled notification which is referred by receipt.
+//  Notification could be cancelled with hash of token which scheduled it or
+//  of any token of its lineage.
+func (s *Storage) CancelScheduled(ctx context.Context, token, id string) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		schedule := tx.Bucket(scheduleName)
+		bytes := schedule.Get([]byte(id))
+
+		if bytes == nil {
+			return ErrUnknownScheduled
+		}
+
+		if n, err := NotificationDecode(bytes); err != nil {
+			return err
+		} else if !lineage(tx, token)[n.Token] {
+			return ErrUnknownScheduled
+		} else if err := schedule.Delete([]byte(id)); err != nil {
+			return err
+		}
+
+		return updateReceipt(tx, id, func(r *Receipt) {
+			r.State = StateCancelled
+		})
+	})
+}
+
+//  digestKey makes key of held notification. Keys are prefixed with user in
+//  order to scan notifications of user at once.
+func digestKey(chat int, receipt string) []byte {
+	return []byte(strconv.Itoa(chat) + "\x00" + receipt)
+}
+
+//  HoldNotification keeps notification until digest of user is sent.
+//  Notification is assigned with receipt in state held.
+func (s *Storage) HoldNotification(ctx context.Context, n *Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		if err := acceptNotification(tx, n, StateHeld); err != nil {
+			return err
+		}
+
+		if bytes, err := n.NotificationEncode(); err != nil {
+			return err
+		} else {
+			return tx.Bucket(digestName).Put(digestKey(n.ChatId, n.ReceiptId), bytes)
+		}
+	})
+}
+
+//  SelectDigests returns held notifications grouped by user. Notifications
+//  are ordered by time of acceptance.
+func (s *Storage) SelectDigests(ctx context.Context) (map[int][]*Notification, error) {
+	digests := map[int][]*Notification{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(digestName).ForEach(func(k, v []byte) error {
+			if n, err := NotificationDecode(v); err != nil {
+				return err
+			} else {
+				digests[n.ChatId] = append(digests[n.ChatId], n)
+				return nil
+			}
+		})
+	})
+
+	for _, held := range digests {
+		sort.SliceStable(held, func(i, j int) bool {
+			return held[i].CreatedAt.Before(held[j].CreatedAt)
+		})
+	}
+
+	return digests, err
+}
+
+//  ReleaseDigest replaces held notifications with summaries in outbox.
+//  Summaries are assigned with unique identifiers and receipts of held
+//  notifications become queued.
+func (s *Storage) ReleaseDigest(ctx context.Context, held, summaries []*Notification) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		digest := tx.Bucket(digestName)
+		outbox := tx.Bucket(outboxName)
+
+		for _, n := range held {
+			if err := digest.Delete(digestKey(n.ChatId, n.ReceiptId)); err != nil {
+				return err
+			}
+		}
+
+		for _, n := range summaries {
+			if id, err := outbox.NextSequence(); err != nil {
+				return err
+			} else {
+				n.Id = id
+			}
+
+			if err := putOutbox(tx, n); err != nil {
+				return err
+			}
+
+			err := updateReceipts(tx, n, func(r *Receipt) {
+				r.State = StateQueued
+				r.NotificationId = n.Id
+			})
+
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
 	})
-	return revoked, err
 }
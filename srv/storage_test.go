@@ -1,8 +1,14 @@
 package srv
 
 import (
+	"bytes"
+	"context"
+	"github.com/boltdb/bolt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestStorage(t *testing.T) {
@@ -10,6 +16,8 @@ func TestStorage(t *testing.T) {
 	storage, err := NewStorage(file.Name())
 	defer storage.Close()
 
+	ctx := context.Background()
+
 	// let Pavel Durov check it out
 	user := &User{
 		Id:        1,
@@ -19,7 +27,7 @@ func TestStorage(t *testing.T) {
 	}
 
 	// place user onto index
-	token, err := storage.InsertUser(user)
+	token, err := storage.InsertUser(ctx, user, time.Now())
 
 	if err != nil {
 		t.Error(err)
@@ -30,7 +38,7 @@ func TestStorage(t *testing.T) {
 	}
 
 	// query user by token
-	usr, err := storage.SelectUserBy(token)
+	usr, err := storage.SelectUserBy(ctx, token)
 
 	if err != nil {
 		t.Error(err)
@@ -42,13 +50,347 @@ func TestStorage(t *testing.T) {
 	}
 
 	// query token by user
-	tok, err := storage.SelectTokenBy(user)
+	tok, err := storage.SelectTokenBy(ctx, user)
 
 	if err != nil {
 		t.Error(err)
 	}
 
-	if tok != token {
+	if tok != storage.HashToken(token) {
 		t.Error("wrong token: ", tok)
 	}
+
+	if !strings.HasPrefix(token, TokenPrefix) || len(token) != 35 {
+		t.Error("wrong format of token: ", token)
+	}
+
+	// the next start rotates default token instead of issuing another one
+	replacement, err := storage.InsertUser(ctx, user, time.Now().Add(time.Hour))
+
+	if err != nil {
+		t.Fatal(err)
+	} else if replacement == token {
+		t.Error("token is not rotated")
+	}
+
+	if tokens, _ := storage.SelectTokens(ctx, user); len(tokens) != 1 ||
+		tokens[0].Label != DefaultLabel || tokens[0].Token != storage.HashToken(replacement) {
+		t.Error("wrong tokens: ", tokens)
+	} else if ut, _ := storage.SelectUserToken(ctx, token); !ut.IsRotated() {
+		t.Error("old token is not rotated: ", ut)
+	}
+
+	// the latest token is rotated if label is omitted
+	if latest, label, err := storage.RotateTokenBy(ctx, user, "", time.Now()); err != nil {
+		t.Error(err)
+	} else if label != DefaultLabel {
+		t.Error("wrong label of rotated token: ", label)
+	} else if tokens, _ := storage.SelectLatestTokens(ctx); len(tokens) != 1 ||
+		tokens[0] != storage.HashToken(latest) {
+		t.Error("wrong latest tokens: ", tokens)
+	}
+}
+
+func TestStorageOutbox(t *testing.T) {
+	file, _ := ioutil.TempFile("", "boltdb-")
+	storage, err := NewStorage(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	ctx := context.Background()
+	n := &Notification{ChatId: 1, Text: "Hello, World!", NextAttempt: time.Now()}
+
+	if err := storage.PutNotification(ctx, n); err != nil {
+		t.Fatal(err)
+	}
+
+	if n.Id == 0 || len(n.ReceiptId) == 0 {
+		t.Error("notification id is not assigned")
+	}
+
+	if r, err := storage.SelectReceipt(ctx, n.ReceiptId); err != nil {
+		t.Error(err)
+	} else if r.State != StateQueued || r.NotificationId != n.Id {
+		t.Error("wrong receipt: ", r)
+	}
+
+	// outbox is scanned by entries which refer to notifications
+	if entries, err := storage.SelectOutbox(ctx); err != nil {
+		t.Error(err)
+	} else if len(entries) != 1 || entries[0].Id != n.Id || entries[0].ChatId != 1 ||
+		!entries[0].NextAttempt.Equal(n.NextAttempt) {
+		t.Error("wrong outbox entries: ", entries)
+	}
+
+	// bury notification and then requeue it
+	if err := storage.BuryNotification(ctx, n); err != nil {
+		t.Error(err)
+	}
+
+	if r, _ := storage.SelectReceipt(ctx, n.ReceiptId); r.State != StateFailed {
+		t.Error("wrong receipt: ", r)
+	}
+
+	if dead, err := storage.SelectDeadNotifications(ctx); err != nil {
+		t.Error(err)
+	} else if len(dead) != 1 || dead[0].Id != n.Id {
+		t.Error("wrong dead notifications: ", dead)
+	}
+
+	if err := storage.RequeueNotification(ctx, n.Id); err != nil {
+		t.Error(err)
+	}
+
+	if dead, _ := storage.SelectDeadNotifications(ctx); len(dead) != 0 {
+		t.Error("wrong dead notifications: ", dead)
+	}
+
+	if m, err := storage.SelectNotification(ctx, n.Id); err != nil || m == nil {
+		t.Error("notification is not requeued: ", err)
+	}
+
+	// deliver notification
+	n.MessageId = 42
+
+	if err := storage.CompleteNotification(ctx, n); err != nil {
+		t.Error(err)
+	}
+
+	if r, _ := storage.SelectReceipt(ctx, n.ReceiptId); r.State != StateSent ||
+		r.MessageId != 42 {
+		t.Error("wrong receipt: ", r)
+	}
+
+	// undeliverable notification is dropped once it is expired
+	m := &Notification{ChatId: 1, Text: "Bye!", NextAttempt: time.Now()}
+
+	if err := storage.PutNotification(ctx, m); err != nil {
+		t.Fatal(err)
+	} else if err := storage.BuryNotification(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.PruneDeadNotifications(ctx, m.NextAttempt); err != nil {
+		t.Error(err)
+	} else if dead, _ := storage.SelectDeadNotifications(ctx); len(dead) != 1 {
+		t.Error("dead notification is dropped too early: ", dead)
+	}
+
+	if err := storage.PruneDeadNotifications(ctx, time.Now().Add(time.Second)); err != nil {
+		t.Error(err)
+	} else if dead, _ := storage.SelectDeadNotifications(ctx); len(dead) != 0 {
+		t.Error("dead notification is not dropped: ", dead)
+	}
+
+	if entries, _ := storage.SelectOutbox(ctx); len(entries) != 0 {
+		t.Error("delivered notification is in outbox: ", entries)
+	}
+}
+
+func TestStorageIdempotencyKey(t *testing.T) {
+	file, err := ioutil.TempFile("", "boltdb-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer os.Remove(TokenKeyPath(file.Name()))
+
+	storage, err := NewStorage(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	push := func(token string) (*Notification, error) {
+		n := &Notification{
+			Token:          token,
+			ChatId:         1,
+			Text:           "Training is finished.",
+			IdempotencyKey: "train-42",
+			CreatedAt:      now,
+		}
+		return n, storage.PutNotification(ctx, n)
+	}
+
+	first, err := push("1234")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same key is bound to the same receipt
+	if n, err := push("1234"); err != ErrRepeatedRequest {
+		t.Error("request is not repeated: ", err)
+	} else if n.ReceiptId != first.ReceiptId || n.Id != 0 {
+		t.Error("wrong receipt of repeated request: ", n.ReceiptId)
+	}
+
+	// keys of different tokens do not clash
+	if _, err := push("5678"); err != nil {
+		t.Error(err)
+	}
+
+	if ns, err := storage.SelectOutbox(ctx); err != nil {
+		t.Fatal(err)
+	} else if len(ns) != 2 {
+		t.Error("wrong number of notifications: ", len(ns))
+	}
+
+	// key could be used again once it is expired
+	if err := storage.PruneIdempotencyKeys(ctx, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if _, err := push("1234"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStorageTokens(t *testing.T) {
+	file, err := ioutil.TempFile("", "boltdb-")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.Remove(file.Name())
+	defer os.Remove(TokenKeyPath(file.Name()))
+
+	storage, err := NewStorage(file.Name())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	user := &User{Id: 1}
+
+	// tokens which are issued before labels are labelled on start up
+	err = storage.db.Update(func(tx *bolt.Tx) error {
+		for _, token := range []string{"1111", "2222"} {
+			bytes, _ := (&UserToken{User: *user}).UserTokenEncode()
+			tx.Bucket(indexName).Put([]byte(token), bytes)
+		}
+
+		// receipts and idempotency keys refer to raw tokens as well
+		if err := putReceipt(tx, &Receipt{Id: "abcd", Token: "2222"}); err != nil {
+			return err
+		}
+
+		key, _ := (&IdempotencyKey{ReceiptId: "abcd"}).IdempotencyKeyEncode()
+
+		if err := tx.Bucket(idempotencyName).Put([]byte("2222\x00retry"), key); err != nil {
+			return err
+		}
+
+		return tx.Bucket(revIndexName).Put([]byte("1"), []byte("2222"))
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage.Close()
+
+	if storage, err = NewStorage(file.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	defer storage.Close()
+
+	// legacy tokens are hashed on start up and they are still valid
+	if ut, err := storage.SelectUserToken(ctx, "2222"); err != nil {
+		t.Fatal(err)
+	} else if ut.Label != DefaultLabel || !ut.Legacy {
+		t.Error("wrong legacy token: ", ut)
+	}
+
+	storage.db.View(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(idempotencyName)
+		hash := storage.HashToken("2222")
+
+		if tx.Bucket(indexName).Get([]byte("2222")) != nil {
+			t.Error("legacy token is not hashed")
+		} else if keys.Get([]byte("2222\x00retry")) != nil {
+			t.Error("idempotency key is not rehashed")
+		} else if keys.Get([]byte(hash+"\x00retry")) == nil {
+			t.Error("idempotency key is lost")
+		}
+
+		return nil
+	})
+
+	if receipt, err := storage.SelectReceipt(ctx, "abcd"); err != nil {
+		t.Fatal(err)
+	} else if receipt.Token != storage.HashToken("2222") {
+		t.Error("token of receipt is not rehashed: ", receipt.Token)
+	}
+
+	if _, err := storage.InsertToken(ctx, user, "laptop", TokenPolicy{}); err != nil {
+		t.Fatal(err)
+	} else if _, err := storage.InsertToken(ctx, user, "laptop", TokenPolicy{}); err != ErrLabelTaken {
+		t.Error("label is not taken: ", err)
+	}
+
+	tokens, err := storage.SelectTokens(ctx, user)
+
+	if err != nil {
+		t.Fatal(err)
+	} else if len(tokens) != 3 || tokens[1].Label != "default-2" ||
+		tokens[2].Label != "laptop" {
+		t.Fatal("wrong tokens: ", tokens)
+	}
+
+	// the latest token is revoked, so another one becomes the latest
+	if err := storage.RevokeToken(ctx, user, "laptop"); err != nil {
+		t.Fatal(err)
+	} else if revoked, _ := storage.IsTokenRevokedBy(ctx, tokens[2].Token); !revoked {
+		t.Error("token is not revoked")
+	} else if token, _ := storage.SelectTokenBy(ctx, user); token == tokens[2].Token {
+		t.Error("revoked token is the latest")
+	}
+
+	if err := storage.RevokeToken(ctx, user, "laptop"); err != ErrUnknownLabel {
+		t.Error("wrong error: ", err)
+	}
+
+	// key kept in database by older versions is moved to file
+	key := storage.key
+	storage.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaName).Put(tokenKeyName, key)
+	})
+	storage.Close()
+	os.Remove(TokenKeyPath(file.Name()))
+
+	if storage, err = NewStorage(file.Name()); err != nil {
+		t.Fatal(err)
+	} else if _, err := storage.SelectUserToken(ctx, "2222"); err != nil {
+		t.Error("token does not match after key is moved: ", err)
+	} else if saved, err := readTokenKey(TokenKeyPath(file.Name())); err != nil ||
+		!bytes.Equal(saved, key) {
+		t.Error("key is not moved to file: ", err)
+	}
+
+	storage.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(metaName).Get(tokenKeyName) != nil {
+			t.Error("key is kept along with hashes")
+		}
+
+		return nil
+	})
+
+	// tokens could not be checked with another key
+	storage.Close()
+
+	if _, err := NewStorage(file.Name(), WithTokenKey([]byte("secret"))); err != ErrWrongTokenKey {
+		t.Error("wrong key is accepted: ", err)
+	}
 }
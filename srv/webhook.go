@@ -0,0 +1,146 @@
+package srv
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// maxSeenUpdates is how many identifiers of the latest updates are kept in
+// order to drop updates which Bot API delivers repeatedly.
+const maxSeenUpdates = 1024
+
+// SetWebhook registers webhook URL with optional self-signed certificate and
+// secret token.
+func (t *TelePyth) SetWebhook(ctx context.Context) error {
+	webhook := &SetWebhook{
+		Url:         t.WebhookURL,
+		SecretToken: t.WebhookSecret,
+	}
+
+	if len(t.WebhookCert) != 0 {
+		file, err := os.Open(t.WebhookCert)
+
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		webhook.Certificate = file
+	}
+
+	return webhook.To(ctx, t.Api)
+}
+
+// checkWebhook makes sure that webhook requests could be authenticated. If
+// there is no secret token then webhook URL should end with bot token since
+// requests are authenticated with the path.
+func (t *TelePyth) checkWebhook() error {
+	if len(t.WebhookURL) == 0 || len(t.WebhookSecret) != 0 {
+		return nil
+	} else if !strings.HasSuffix(t.WebhookURL, "/api/webhook/"+t.Api.GetToken()) {
+		return errors.New("webhook url should end with /api/webhook/<bot token> " +
+			"if webhook secret is not set")
+	}
+
+	return nil
+}
+
+// HandleWebhookRequest accepts update from Bot API and puts it into queue of
+// updates. Request is authenticated with secret token in header if it is
+// configured and with bot token in path otherwise.
+func (t *TelePyth) HandleWebhookRequest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var secret, expected string
+
+	if len(t.WebhookSecret) != 0 {
+		secret = req.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		expected = t.WebhookSecret
+	} else {
+		secret = req.URL.Path
+		expected = "/api/webhook/" + t.Api.GetToken()
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	update := Update{}
+
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch t.enqueueUpdate(&update) {
+	case updateRepeated:
+		log.Println("drop repeated update", update.UpdateId)
+		w.WriteHeader(http.StatusOK)
+	case updateQueued:
+		w.WriteHeader(http.StatusOK)
+	default:
+		// ask Bot API to repeat update later
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+const (
+	updateQueued = iota
+	updateRepeated
+	updateDropped
+)
+
+// enqueueUpdate puts update into queue unless update with the same
+// identifier has been seen already or queue is full. The latest identifiers
+// are remembered while the oldest ones are forgotten.
+func (t *TelePyth) enqueueUpdate(update *Update) int {
+	t.seenMu.Lock()
+	defer t.seenMu.Unlock()
+
+	if t.seenUpdates[update.UpdateId] {
+		return updateRepeated
+	}
+
+	select {
+	case t.updates <- *update:
+	default:
+		return updateDropped
+	}
+
+	if t.seenUpdates == nil {
+		t.seenUpdates = make(map[int]bool)
+	}
+
+	t.seenUpdates[update.UpdateId] = true
+	t.seenOrder = append(t.seenOrder, update.UpdateId)
+
+	if len(t.seenOrder) > maxSeenUpdates {
+		delete(t.seenUpdates, t.seenOrder[0])
+		t.seenOrder = t.seenOrder[1:]
+	}
+
+	return updateQueued
+}
+
+// ConsumeUpdates handles updates received with webhook one by one. It
+// returns when context is cancelled.
+func (t *TelePyth) ConsumeUpdates(ctx context.Context) {
+	for {
+		select {
+		case update := <-t.updates:
+			t.HandleTelegramUpdate(ctx, &update)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
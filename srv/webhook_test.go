@@ -0,0 +1,69 @@
+package srv
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleWebhookRequest(t *testing.T) {
+	telepyth := &TelePyth{
+		Api:           New("42:token"),
+		WebhookSecret: "secret",
+		updates:       make(chan Update, 10),
+	}
+
+	request := func(secret string) int {
+		body := strings.NewReader(`{"update_id": 7, "message": {"text": "/help"}}`)
+		req := httptest.NewRequest("POST", "/api/webhook/", body)
+		req.Header.Set("X-Telegram-Bot-Api-Secret-Token", secret)
+		rec := httptest.NewRecorder()
+		telepyth.HandleWebhookRequest(rec, req)
+		return rec.Code
+	}
+
+	if code := request("wrong"); code != http.StatusUnauthorized {
+		t.Error("wrong status: ", code)
+	}
+
+	// the same update is accepted twice but it is queued once
+	for i := 0; i != 2; i++ {
+		if code := request("secret"); code != http.StatusOK {
+			t.Error("wrong status: ", code)
+		}
+	}
+
+	if len(telepyth.updates) != 1 {
+		t.Fatal("wrong number of queued updates: ", len(telepyth.updates))
+	}
+
+	if update := <-telepyth.updates; update.Message.Text != "/help" {
+		t.Error("wrong update: ", update)
+	}
+}
+
+func TestCheckWebhook(t *testing.T) {
+	telepyth := &TelePyth{
+		Api:        New("42:token"),
+		WebhookURL: "https://telepyth.example.com/api/webhook/",
+	}
+
+	// webhook requests could not be authenticated
+	if err := telepyth.checkWebhook(); err == nil {
+		t.Error("webhook without secret is accepted")
+	}
+
+	telepyth.WebhookURL += "42:token"
+
+	if err := telepyth.checkWebhook(); err != nil {
+		t.Error(err)
+	}
+
+	telepyth.WebhookURL = "https://telepyth.example.com/api/webhook/"
+	telepyth.WebhookSecret = "secret"
+
+	if err := telepyth.checkWebhook(); err != nil {
+		t.Error(err)
+	}
+}
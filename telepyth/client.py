@@ -3,6 +3,7 @@
 
 from configparser import ConfigParser
 from io import BytesIO, StringIO
+from json import loads
 from os.path import expanduser
 from sys import exc_info, stderr
 from traceback import print_exception
@@ -48,6 +49,9 @@ class TelePythClient(object):
         if debug:
             self.base_url = TelePythClient.DEBUG_URL
 
+        # receipt of the last accepted notification
+        self.receipt = None
+
     def __call__(self, text, markdown=True):
         if not self.access_token:
             raise ValueError('Access token is not provided. '
@@ -58,25 +62,42 @@ class TelePythClient(object):
         url = self.base_url + self.access_token
 
         req = Request(url, method='POST')
-        req.add_header('Content-Type', 'plain/text; encoding=utf-8')
+        req.add_header('Content-Type', 'text/plain; charset=utf-8')
         req.add_header('User-Agent', TelePythClient.UA)
         req.data = text.read().encode('utf8')  # support for 3.4+
 
         try:
             res = urlopen(req)
-
-            if res.getcode() != 200:
-                lines = '\n'.join(res.readlines())
-                msg = f'[{res.getcode()}] {res.reason}: {lines}'
-                print(msg, file=stderr)
-
-            return res.getcode()
+            return self._receive(res)
         except Exception as e:
             # TODO: handle more accuratly exceptions
             print('During request exception was raised:', e, file=stderr)
             print_exception(*exc_info(), limit=42, file=stderr)
             return None
 
+    def _receive(self, res):
+        """Read receipt of notification from response. Server responds with
+        200 once notification is delivered and with 202 once it is accepted
+        but not delivered yet (e.g. it is queued, scheduled, held for digest
+        or postponed till the end of quiet hours).
+
+        :param res: response of server.
+        :return: status code.
+        """
+        code = res.getcode()
+        body = res.read().decode('utf8')
+
+        if not 200 <= code < 300:
+            print(f'[{code}] {res.reason}: {body}', file=stderr)
+            return code
+
+        try:
+            self.receipt = loads(body)
+        except ValueError:
+            self.receipt = None
+
+        return code
+
     def __repr__(self):
         template = '<TelePythClient token={token} url={url}>'
         return template.format(url=self.base_url, token=self.access_token)
@@ -150,4 +171,4 @@ class TelePythClient(object):
 
         res = urlopen(req)
 
-        return res.getcode()
+        return self._receive(res)
@@ -5,68 +5,34 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"flag"
 	"io/ioutil"
 	"log"
 	"text/template"
 
-	"github.com/boltdb/bolt"
 	"github.com/daskol/telepyth/srv"
 )
 
-func notify(db *srv.Storage, token string, api *srv.TelegramBotApi, tpl *template.Template) error {
+func notify(ctx context.Context, db *srv.Storage, hash string, dispatcher *srv.Dispatcher, tpl *template.Template) error {
 	buffer := &bytes.Buffer{}
-	user, err := db.SelectUserBy(token)
+	user, err := db.SelectHashedToken(ctx, hash)
 
 	if err != nil {
 		return err
 	}
 
-	if err := tpl.Execute(buffer, user); err != nil {
+	if err := tpl.Execute(buffer, user.User); err != nil {
 		return err
 	}
 
-	return (&srv.SendMessage{
+	_, err = dispatcher.Send(ctx, &srv.SendMessage{
 		ChatId:    user.Id,
 		Text:      buffer.String(),
 		ParseMode: "markdown",
-	}).To(api)
-}
-
-func listTokens(dsn string) ([]string, error) {
-	log.Println("open boltdb from " + dsn)
-	var storage *bolt.DB
-
-	if db, err := bolt.Open(dsn, 0600, nil); err != nil {
-		return nil, err
-	} else {
-		storage = db
-		defer storage.Close()
-	}
-
-	log.Println("get tokens of distinct users")
-	tokens := []string{}
-
-	err := storage.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("rev-index"))
-
-		if bucket == nil {
-			return errors.New("there is not bucket rev-index")
-		}
-
-		return bucket.ForEach(func(k, v []byte) error {
-			tokens = append(tokens, string(v))
-			log.Printf("%04d append %s", len(tokens), string(v))
-			return nil
-		})
-	})
-
-	if err != nil {
-		return nil, err
-	}
+	}, srv.PriorityBulk)
 
-	return tokens, nil
+	return err
 }
 
 func main() {
@@ -75,6 +41,8 @@ func main() {
 	apiToken := flag.String("api-token", "", "Telegram Bot API token.")
 	testToken := flag.String("test-token", "",
 		"Telepyth access token of test announcement.")
+	tokenKey := flag.String("token-key", "",
+		"Secret key of token hashes (token_key in server config).")
 
 	flag.Parse()
 
@@ -96,33 +64,49 @@ func main() {
 	log.Println("init telegram bot api client")
 	api := srv.New(*apiToken)
 
-	if me, err := api.GetMe(); err != nil {
+	ctx := context.Background()
+
+	if me, err := api.GetMe(ctx); err != nil {
 		log.Fatal(err)
 	} else {
 		log.Printf("me: [%d] %s %s @%s\n",
 			me.Id, me.FirstName, me.LastName, me.UserName)
 	}
 
-	log.Println("list avaliable user tokens from rev-index")
-	tokens, err := listTokens(*dsn)
+	dispatcher := srv.NewDispatcher(api)
+	go dispatcher.Run(ctx)
+
+	log.Println("open telepyth user storage")
+	opts := []srv.StorageOption{}
+
+	if len(*tokenKey) != 0 {
+		opts = append(opts, srv.WithTokenKey([]byte(*tokenKey)))
+	}
+
+	// storage is opened first, so tokens of legacy database are hashed
+	db, err := srv.NewStorage(*dsn, opts...)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("open telepyth user storage")
-	db, err := srv.NewStorage(*dsn)
+	defer db.Close()
+
+	log.Println("get tokens of distinct users")
+	tokens, err := db.SelectLatestTokens(ctx)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	defer db.Close()
+	for idx, token := range tokens {
+		log.Printf("%04d append %s", idx+1, srv.RedactToken(token))
+	}
 
 	if len(*testToken) != 0 {
 		log.Println("send test notification")
 
-		if err := notify(db, *testToken, api, tpl); err != nil {
+		if err := notify(ctx, db, db.HashToken(*testToken), dispatcher, tpl); err != nil {
 			log.Fatal(err)
 		}
 	} else {
@@ -131,11 +115,12 @@ func main() {
 		for idx, token := range tokens {
 			res := "success"
 
-			if err := notify(db, token, api, tpl); err != nil {
+			if err := notify(ctx, db, token, dispatcher, tpl); err != nil {
 				res = err.Error()
 			}
 
-			log.Printf("%04d notify user with token %s: %s", idx, token, res)
+			log.Printf("%04d notify user with token %s: %s", idx,
+				srv.RedactToken(token), res)
 		}
 	}
 
@@ -58,8 +58,8 @@ func main() {
 				return err
 			}
 
-			log.Printf("%d = %s -> %d(%t)\n", index, string(k), val.User.Id,
-				val.IsTokenRevoked)
+			log.Printf("%d = %s -> %d(%t) %s %s\n", index, string(k), val.User.Id,
+				val.IsTokenRevoked, val.Label, val.Hint)
 			index += 1
 			return nil
 		})